@@ -0,0 +1,85 @@
+package chrootprep
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// tarPreserveFlags are the GNU tar flags that keep a root filesystem intact
+var tarPreserveFlags = []string{
+	"--numeric-owner",
+	"--xattrs",
+	"--xattrs-include=*",
+}
+
+// tarCompressionFlag returns the tar compression flag matching an archive file name
+func tarCompressionFlag(archive string) (string, error) {
+	name := strings.ToLower(filepath.Base(archive))
+	switch {
+	case strings.HasSuffix(name, ".tar"):
+		return "", nil
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return "--gzip", nil
+	case strings.HasSuffix(name, ".tar.zst"), strings.HasSuffix(name, ".tar.zstd"):
+		return "--zstd", nil
+	default:
+		return "", fmt.Errorf("unsupported archive name %s (use .tar, .tar.gz or .tar.zst)", archive)
+	}
+}
+
+// exportRootfsTar writes chrootDir into a tarball
+func (op *operation) exportRootfsTar(chrootDir string, archive string) error {
+	compression, err := tarCompressionFlag(archive)
+	if err != nil {
+		return err
+	}
+
+	args := []string{"--create", "--file", archive, "--directory", chrootDir, "--sparse", "--one-file-system"}
+	args = append(args, tarPreserveFlags...)
+	if compression != "" {
+		args = append(args, compression)
+	}
+	args = append(args, ".")
+
+	if err := op.runTar(args); err != nil {
+		// Don't leave a truncated archive behind
+		removeIfExists(archive)
+		return err
+	}
+
+	return nil
+}
+
+// importRootfsTar extracts a tarball into chrootDir
+func (op *operation) importRootfsTar(archive string, chrootDir string) error {
+	if !fileExists(archive) {
+		return fmt.Errorf("archive %s %w", archive, ErrNotExist)
+	}
+
+	// Compression is detected by tar itself when extracting
+	args := []string{"--extract", "--file", archive, "--directory", chrootDir, "--same-owner", "--preserve-permissions"}
+	args = append(args, tarPreserveFlags...)
+
+	return op.runTar(args)
+}
+
+// runTar runs GNU tar with the given arguments
+func (op *operation) runTar(args []string) error {
+	cmd := op.command("tar", args...)
+	if err := op.runCommand(cmd); err != nil {
+		return fmt.Errorf("tar failed: %w", err)
+	}
+	return nil
+}
+
+// validateNotMounted ensures no essential filesystems are mounted in chrootDir
+func (op *operation) validateNotMounted(chrootDir string) error {
+	for _, dir := range []string{"dev", "proc", "sys"} {
+		mountpoint := filepath.Join(chrootDir, dir)
+		if op.isMounted(mountpoint) {
+			return fmt.Errorf("%s is %w, run cleanup first", mountpoint, ErrMounted)
+		}
+	}
+	return nil
+}
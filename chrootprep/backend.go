@@ -0,0 +1,92 @@
+package chrootprep
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Layering backend names
+const (
+	BackendOverlay = "overlay"
+	BackendBtrfs   = "btrfs"
+	BackendCopy    = "copy"
+)
+
+// Backend implements the storage and mounting of named environments on a
+// base. The environment's root filesystem is always found at its merged
+// directory, whatever backend provides it.
+type Backend interface {
+	// Validate checks that an existing environment has the storage the backend expects
+	Validate(chrootDir string, overlayName string) error
+	// Prepare creates the storage of a new environment, or checks that of an existing one
+	Prepare(chrootDir string, meta *OverlayMetadata, opts SetupOptions) error
+	// Mount makes the environment's root filesystem available at its merged directory
+	Mount(chrootDir string, meta *OverlayMetadata, readOnly bool) error
+	// Unmount removes the environment's root filesystem from its merged directory
+	Unmount(chrootDir string, overlayName string) error
+	// Release frees the resources held since Prepare, keeping persistent changes
+	Release(chrootDir string, overlayName string) error
+	// IsMounted checks if the environment's root filesystem is set up
+	IsMounted(chrootDir string, overlayName string) bool
+	// Delete removes the backend storage of an environment before its directory is deleted
+	Delete(chrootDir string, overlayName string) error
+	// Clone copies the changes of an environment into the directory of a new one
+	Clone(chrootDir string, overlayName string, newName string) error
+	// Reset discards all changes of an unmounted environment
+	Reset(chrootDir string, meta *OverlayMetadata) error
+	// Layers returns the directories making up the environment's root filesystem, topmost first
+	Layers(chrootDir string, meta *OverlayMetadata) []string
+	// Materialize copies the environment's root filesystem into a new directory
+	Materialize(chrootDir string, meta *OverlayMetadata, dest string) error
+}
+
+// backends creates the available layering backends by name, for an operation
+var backends = map[string]func(op *operation) Backend{
+	BackendOverlay: func(op *operation) Backend { return overlayBackend{op} },
+	BackendBtrfs:   func(op *operation) Backend { return btrfsBackend{treeBackend{op}} },
+	BackendCopy:    func(op *operation) Backend { return copyBackend{treeBackend{op}} },
+}
+
+// getBackend returns a backend by name, the overlay backend being the default
+func (op *operation) getBackend(name string) (Backend, error) {
+	if name == "" {
+		name = BackendOverlay
+	}
+
+	newBackend, ok := backends[name]
+	if !ok {
+		names := make([]string, 0, len(backends))
+		for name := range backends {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown backend '%s' (use %s)", name, strings.Join(names, ", "))
+	}
+
+	return newBackend(op), nil
+}
+
+// getOverlayBackend returns the backend recorded in an environment's
+// metadata. Environments without metadata, such as those backed by an
+// unmounted tmpfs, use the overlay backend.
+func (op *operation) getOverlayBackend(chrootDir string, overlayName string) Backend {
+	meta, err := op.readOverlayMetadata(chrootDir, overlayName)
+	if err != nil || meta == nil {
+		return overlayBackend{op}
+	}
+
+	backend, err := op.getBackend(meta.Backend)
+	if err != nil {
+		return overlayBackend{op}
+	}
+	return backend
+}
+
+// backendName returns the name of the backend recorded in metadata
+func backendName(meta *OverlayMetadata) string {
+	if meta == nil || meta.Backend == "" {
+		return BackendOverlay
+	}
+	return meta.Backend
+}
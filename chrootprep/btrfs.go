@@ -0,0 +1,139 @@
+package chrootprep
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// btrfsSuperMagic is the filesystem type of btrfs reported by statfs
+const btrfsSuperMagic = 0x9123683e
+
+// btrfsFirstFreeObjectID is the inode number of the root of every btrfs subvolume
+const btrfsFirstFreeObjectID = 256
+
+// btrfsBackend stores an environment as a writable btrfs snapshot of the
+// base subvolume, or of its parent's snapshot, kept at the merged directory
+type btrfsBackend struct {
+	treeBackend
+}
+
+// isBtrfsSubvolume checks if a directory is the root of a btrfs subvolume
+func isBtrfsSubvolume(path string) bool {
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(path, &fs); err != nil || fs.Type != btrfsSuperMagic {
+		return false
+	}
+
+	var st syscall.Stat_t
+	if err := syscall.Lstat(path, &st); err != nil {
+		return false
+	}
+	return st.Mode&syscall.S_IFMT == syscall.S_IFDIR && st.Ino == btrfsFirstFreeObjectID
+}
+
+// runBtrfs runs a btrfs subcommand
+func (op *operation) runBtrfs(args ...string) error {
+	cmd := op.command("btrfs", args...)
+	if err := op.runCommand(cmd); err != nil {
+		return fmt.Errorf("btrfs %s failed: %w", args[0]+" "+args[1], err)
+	}
+	return nil
+}
+
+// createBtrfsSnapshot creates the snapshot of a new environment at its merged directory
+func (op *operation) createBtrfsSnapshot(chrootDir string, meta *OverlayMetadata) error {
+	source, err := op.treeSource(chrootDir, meta)
+	if err != nil {
+		return err
+	}
+
+	if !isBtrfsSubvolume(source) {
+		return fmt.Errorf("%s is not a btrfs subvolume", source)
+	}
+
+	overlayDir := op.getOverlayDir(chrootDir, meta.Name)
+	if err := ensureDir(overlayDir, 0755); err != nil {
+		return fmt.Errorf("failed to create overlay directory: %w", err)
+	}
+
+	_, _, merged := op.getOverlayPaths(chrootDir, meta.Name)
+	return op.runBtrfs("subvolume", "snapshot", source, merged)
+}
+
+// Validate checks that the merged directory is a btrfs subvolume
+func (b btrfsBackend) Validate(chrootDir string, overlayName string) error {
+	_, _, merged := b.getOverlayPaths(chrootDir, overlayName)
+	if !isBtrfsSubvolume(merged) {
+		return fmt.Errorf("btrfs snapshot %s does not exist", merged)
+	}
+	return nil
+}
+
+// Prepare snapshots the base or the parent environment on first use
+func (b btrfsBackend) Prepare(chrootDir string, meta *OverlayMetadata, opts SetupOptions) error {
+	if err := validateTreeOptions(meta, opts); err != nil {
+		return err
+	}
+
+	_, _, merged := b.getOverlayPaths(chrootDir, meta.Name)
+	if isBtrfsSubvolume(merged) {
+		return nil
+	}
+
+	return b.createBtrfsSnapshot(chrootDir, meta)
+}
+
+// Delete deletes the snapshot subvolume
+func (b btrfsBackend) Delete(chrootDir string, overlayName string) error {
+	_, _, merged := b.getOverlayPaths(chrootDir, overlayName)
+	if !isBtrfsSubvolume(merged) {
+		return nil
+	}
+	return b.runBtrfs("subvolume", "delete", merged)
+}
+
+// Clone snapshots the environment's snapshot
+func (b btrfsBackend) Clone(chrootDir string, overlayName string, newName string) error {
+	if err := ensureDir(b.getOverlayDir(chrootDir, newName), 0755); err != nil {
+		return fmt.Errorf("failed to create overlay directory: %w", err)
+	}
+
+	_, _, merged := b.getOverlayPaths(chrootDir, overlayName)
+	_, _, newMerged := b.getOverlayPaths(chrootDir, newName)
+	return b.runBtrfs("subvolume", "snapshot", merged, newMerged)
+}
+
+// Reset replaces the snapshot with a fresh snapshot of its source
+func (b btrfsBackend) Reset(chrootDir string, meta *OverlayMetadata) error {
+	if err := b.Delete(chrootDir, meta.Name); err != nil {
+		return err
+	}
+	return b.createBtrfsSnapshot(chrootDir, meta)
+}
+
+// Materialize snapshots the environment when dest is on the same btrfs
+// filesystem, and copies it otherwise
+func (b btrfsBackend) Materialize(chrootDir string, meta *OverlayMetadata, dest string) error {
+	_, _, merged := b.getOverlayPaths(chrootDir, meta.Name)
+
+	// Snapshots cannot cross filesystems, in which case nothing is created
+	if b.command("btrfs", "subvolume", "snapshot", merged, dest).Run() == nil {
+		return nil
+	}
+
+	// Contents of /proc, /dev and /sys must not end up in the copy
+	if err := b.validateNotMounted(merged); err != nil {
+		return err
+	}
+
+	if err := ensureDir(dest, 0755); err != nil {
+		return err
+	}
+
+	if err := b.copyTree(merged, dest); err != nil {
+		removeIfExists(dest)
+		return err
+	}
+
+	return nil
+}
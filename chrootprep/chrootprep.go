@@ -0,0 +1,202 @@
+// Package chrootprep sets up chroot environments: it mounts the host
+// filesystems a chroot needs, and layers named overlays on a base directory
+// or image so that the base itself is never changed.
+//
+// An Environment designates a base, or one of its overlays, and its methods
+// run the operations of the chroot-prep command on it:
+//
+//	env, err := chrootprep.New("/srv/trixie", "build", chrootprep.Options{})
+//	if err != nil {
+//		return err
+//	}
+//	if err := env.Setup(ctx, chrootprep.SetupOptions{Tmpfs: true}); err != nil {
+//		return err
+//	}
+//	defer env.Cleanup(ctx)
+//
+// Operations mount filesystems and must run as root. Operations on
+// different bases may run concurrently, those on the same base must not.
+package chrootprep
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path/filepath"
+)
+
+// Options configures where an environment stores its overlays and where it
+// reports progress
+type Options struct {
+	// OverlayRoot stores overlays under <root>/<base name>/<overlay name>
+	// instead of next to the base. Overlays next to the base are still found.
+	OverlayRoot string
+	// Logger receives progress messages and warnings, nil to discard them
+	Logger Logger
+	// Mounter attaches and detaches filesystems, nil for the system calls
+	Mounter Mounter
+	// ImageMountRoot is where image bases are mounted, ImageMountRoot when empty
+	ImageMountRoot string
+}
+
+// Environment is a base chroot environment, a directory or an image, or a
+// named overlay of one
+type Environment struct {
+	dir            string
+	overlay        string
+	overlayRoot    string
+	imageMountRoot string
+	logger         Logger
+	mounter        Mounter
+	// preflightChecks are run before mounting overlays
+	preflightChecks []preflightCheck
+}
+
+// New returns the environment of the base at dir, or of its overlay
+// overlayName when it is not empty. Neither has to exist yet.
+func New(dir string, overlayName string, opts Options) (*Environment, error) {
+	if overlayName != "" {
+		if err := validateOverlayName(overlayName); err != nil {
+			return nil, err
+		}
+	}
+
+	env, err := newEnvironment(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if env.dir, err = filepath.Abs(dir); err != nil {
+		return nil, fmt.Errorf("failed to get absolute path: %w", err)
+	}
+	env.overlay = overlayName
+
+	return env, nil
+}
+
+// newEnvironment returns an environment configured by opts, without a base
+func newEnvironment(opts Options) (*Environment, error) {
+	env := &Environment{logger: opts.Logger, mounter: opts.Mounter, imageMountRoot: ImageMountRoot, preflightChecks: preflightChecks}
+	if env.logger == nil {
+		env.logger = discardLogger{}
+	}
+	if env.mounter == nil {
+		env.mounter = SystemMounter{}
+	}
+
+	if opts.OverlayRoot != "" {
+		var err error
+		if env.overlayRoot, err = filepath.Abs(opts.OverlayRoot); err != nil {
+			return nil, fmt.Errorf("failed to get absolute path: %w", err)
+		}
+	}
+
+	if opts.ImageMountRoot != "" {
+		var err error
+		if env.imageMountRoot, err = filepath.Abs(opts.ImageMountRoot); err != nil {
+			return nil, fmt.Errorf("failed to get absolute path: %w", err)
+		}
+	}
+
+	return env, nil
+}
+
+// Resolve is like New, but path may also be an overlay directory or any
+// path inside the merged view of an overlay, designating that overlay of its
+// base. Overlays found under another overlay root than opts.OverlayRoot
+// make it the overlay root of the environment.
+func Resolve(path string, overlayName string, opts Options) (*Environment, error) {
+	env, err := New(path, overlayName, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	err = env.run(context.Background(), func(op *operation) error {
+		chrootDir, resolvedName, overlayRoot, ok := op.resolveEnvironment(env.dir)
+		if !ok {
+			return nil
+		}
+
+		if overlayName != "" && overlayName != resolvedName {
+			return fmt.Errorf("%s belongs to overlay '%s' of %s, not to overlay '%s'", env.dir, resolvedName, chrootDir, overlayName)
+		}
+
+		env.dir, env.overlay, env.overlayRoot = chrootDir, resolvedName, overlayRoot
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return env, nil
+}
+
+// Dir returns the absolute path of the base
+func (e *Environment) Dir() string {
+	return e.dir
+}
+
+// Overlay returns the name of the overlay, empty for the base itself
+func (e *Environment) Overlay() string {
+	return e.overlay
+}
+
+// WithOverlay returns the environment of another overlay of the same base
+func (e *Environment) WithOverlay(overlayName string) (*Environment, error) {
+	if err := validateOverlayName(overlayName); err != nil {
+		return nil, err
+	}
+
+	env := *e
+	env.overlay = overlayName
+	return &env, nil
+}
+
+// requireOverlay fails for operations that only apply to overlays
+func (e *Environment) requireOverlay() error {
+	if e.overlay == "" {
+		return fmt.Errorf("%s: an overlay name is required", e.dir)
+	}
+	return nil
+}
+
+// RemoveOptions holds optional settings for Remove
+type RemoveOptions struct {
+	// Force deletes directories even if unmounting fails
+	Force bool
+}
+
+// ResetOptions holds optional settings for Reset
+type ResetOptions struct {
+	// Remount sets the overlay up again, the way it was, after resetting it
+	Remount bool
+}
+
+// CheckOptions holds optional settings for Check
+type CheckOptions struct {
+	// MountOptions are the extra overlayfs mount options of a new overlay
+	MountOptions []string
+}
+
+// DoctorOptions holds optional settings for Doctor
+type DoctorOptions struct {
+	// Fix repairs the problems found
+	Fix bool
+	// DeleteOrphans lets Fix delete overlays whose base no longer exists,
+	// which are only reported otherwise
+	DeleteOrphans bool
+}
+
+// DiffOptions holds optional settings for Diff
+type DiffOptions struct {
+	// Output receives a line per differing path, nil to only count them
+	Output io.Writer
+	// Content adds unified diffs of changed files to the output
+	Content bool
+}
+
+// PackOptions holds optional settings for Pack
+type PackOptions struct {
+	// Format is the image format, squashfs or erofs, empty to use the extension
+	Format string
+}
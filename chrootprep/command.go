@@ -0,0 +1,1195 @@
+package chrootprep
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Setup sets up the chroot environment
+func (e *Environment) Setup(ctx context.Context, opts SetupOptions) error {
+	return e.run(ctx, func(op *operation) error {
+		if opts.ReadOnly && opts.Tmpfs {
+			return fmt.Errorf("a read-only overlay has no upper layer to keep on a tmpfs")
+		}
+
+		if _, err := op.getBackend(opts.Backend); err != nil {
+			return err
+		}
+
+		if opts.Quota != "" && opts.Tmpfs {
+			return fmt.Errorf("a tmpfs-backed overlay is limited with -size instead of -quota")
+		}
+
+		if e.overlay != "" && isImageBase(e.dir) {
+			return op.setupImageOverlayEnvironment(e.dir, e.overlay, opts)
+		}
+
+		if e.overlay != "" {
+			return op.setupOverlayEnvironment(e.dir, e.overlay, opts)
+		}
+
+		if isImageBase(e.dir) {
+			return fmt.Errorf("image base %s can only be used in overlay mode", e.dir)
+		}
+
+		if opts.Tmpfs {
+			return fmt.Errorf("tmpfs storage is only available in overlay mode")
+		}
+
+		if opts.Quota != "" {
+			return fmt.Errorf("quotas are only available in overlay mode")
+		}
+
+		if opts.Backend != "" || opts.AllowCopy {
+			return fmt.Errorf("layering backends are only available in overlay mode")
+		}
+
+		if opts.From != "" {
+			return fmt.Errorf("stacking on a parent overlay is only available in overlay mode")
+		}
+
+		if len(opts.MountOptions) > 0 {
+			return fmt.Errorf("overlayfs mount options are only available in overlay mode")
+		}
+
+		if opts.ProtectBase {
+			return fmt.Errorf("base protection is only available in overlay mode")
+		}
+
+		if opts.AcceptDrift {
+			return fmt.Errorf("base drift is only checked in overlay mode")
+		}
+
+		if opts.ReadOnly {
+			return op.setupReadOnlyEnvironment(e.dir)
+		}
+
+		if isVersionBase(e.dir) {
+			return fmt.Errorf("version %s is immutable, set it up with -readonly or create an overlay on it", e.dir)
+		}
+		return op.setupNormalEnvironment(e.dir)
+	})
+}
+
+// Cleanup cleans up the chroot environment
+func (e *Environment) Cleanup(ctx context.Context) error {
+	return e.run(ctx, func(op *operation) error {
+		if e.overlay != "" {
+			// Cleanup specific overlay
+			if err := op.cleanupOverlayEnvironment(e.dir, e.overlay); err != nil {
+				return err
+			}
+			// Release the image base once its last overlay is unmounted
+			return op.detachImageBase(e.dir)
+		}
+
+		if isImageBase(e.dir) {
+			return fmt.Errorf("image base %s can only be used in overlay mode", e.dir)
+		}
+
+		// Cleanup normal chroot
+		return op.cleanupNormalEnvironment(e.dir)
+	})
+}
+
+// CleanupResult is the outcome of cleaning up one environment in CleanupAll
+type CleanupResult struct {
+	// Name is "base", or "overlay '<name>'"
+	Name   string
+	Result string
+	Err    error
+}
+
+// CleanupAll cleans up every overlay of the base and the base itself, and
+// returns the result for each. Nothing is deleted, except the contents of
+// tmpfs-backed overlays which do not outlive their setup.
+func (e *Environment) CleanupAll(ctx context.Context) ([]CleanupResult, error) {
+	var results []CleanupResult
+	err := e.run(ctx, func(op *operation) error {
+		if !pathExists(e.dir) {
+			return fmt.Errorf("chroot directory %s %w", e.dir, ErrNotExist)
+		}
+
+		failed := 0
+		report := func(name string, result string, err error) {
+			if err != nil {
+				failed++
+				result = fmt.Sprintf("failed: %v", err)
+			}
+			results = append(results, CleanupResult{Name: name, Result: result, Err: err})
+		}
+
+		// Overlays first, so that the base protection is released with the last one
+		overlays := op.findOverlays(e.dir)
+		sort.Strings(overlays)
+		for _, name := range overlays {
+			if op.detectEnvironmentType(e.dir, name) != OverlayEnvironment {
+				continue
+			}
+
+			label := fmt.Sprintf("overlay '%s'", name)
+			if !op.isOverlaySetup(e.dir, name) && !op.isTmpfsOverlay(e.dir, name) {
+				report(label, "not set up", nil)
+				continue
+			}
+			report(label, "cleaned up", op.cleanupOverlayEnvironment(e.dir, name))
+		}
+
+		// Storage images left attached by commands reading their overlay, or
+		// for an overlay stacked on theirs, are detached once all are cleaned up
+		for _, name := range overlays {
+			overlayDir := op.getOverlayDir(e.dir, name)
+			if !op.isQuotaOverlay(e.dir, name) || !op.isMounted(overlayDir) {
+				continue
+			}
+
+			label := fmt.Sprintf("overlay '%s' storage", name)
+			if err := op.releaseOverlayStorage(e.dir, name); err != nil || op.isMounted(overlayDir) {
+				report(label, "still used by mounted overlays", err)
+			} else {
+				report(label, "image detached", nil)
+			}
+		}
+
+		switch {
+		case isImageBase(e.dir):
+			if !op.isMounted(op.getBaseRoot(e.dir)) {
+				report("base", "not mounted", nil)
+			} else if err := op.detachImageBase(e.dir); err != nil || op.isMounted(op.getBaseRoot(e.dir)) {
+				report("base", "still used by mounted overlays", err)
+			} else {
+				report("base", "image unmounted", nil)
+			}
+
+		case op.validateNotMounted(e.dir) == nil && !op.isReadOnlyBindMount(e.dir):
+			report("base", "not set up", nil)
+
+		default:
+			report("base", "cleaned up", op.cleanupNormalEnvironment(e.dir))
+		}
+
+		if failed > 0 {
+			return fmt.Errorf("%d of %d environments could not be cleaned up", failed, len(results))
+		}
+		return nil
+	})
+	return results, err
+}
+
+// Remove removes the overlay, or the base and all of its overlays
+func (e *Environment) Remove(ctx context.Context, opts RemoveOptions) error {
+	return e.run(ctx, func(op *operation) error {
+		// If overlay name is specified, remove only that overlay
+		if e.overlay != "" {
+			if err := op.removeSpecificOverlay(e.dir, e.overlay, opts.Force); err != nil {
+				return err
+			}
+			// Release the image base once its last overlay is unmounted
+			return op.detachImageBase(e.dir)
+		}
+
+		// Remove everything (base + all overlays)
+		return op.removeAll(e.dir, opts.Force)
+	})
+}
+
+// List returns the versions and overlays of the base
+func (e *Environment) List(ctx context.Context) (*Listing, error) {
+	var listing *Listing
+	err := e.run(ctx, func(op *operation) error {
+		// Image bases are listed without being mounted
+		if !isImageBase(e.dir) {
+			if err := validateChrootStructure(e.dir); err != nil {
+				return err
+			}
+		}
+
+		listing = op.listOverlays(e.dir)
+		return nil
+	})
+	return listing, err
+}
+
+// Status returns the state, storage and disk usage of the overlay
+func (e *Environment) Status(ctx context.Context) (*OverlayStatus, error) {
+	var status *OverlayStatus
+	err := e.run(ctx, func(op *operation) error {
+		if err := e.requireOverlay(); err != nil {
+			return err
+		}
+
+		var err error
+		status, err = op.overlayStatus(e.dir, e.overlay)
+		return err
+	})
+	return status, err
+}
+
+// Clone copies the overlay's changes into a new overlay of the same base
+func (e *Environment) Clone(ctx context.Context, newName string) error {
+	return e.run(ctx, func(op *operation) error {
+		if err := e.requireOverlay(); err != nil {
+			return err
+		}
+
+		if err := validateOverlayName(newName); err != nil {
+			return err
+		}
+
+		if err := op.cloneOverlay(e.dir, e.overlay, newName); err != nil {
+			return err
+		}
+
+		op.logf("Successfully cloned overlay '%s' to '%s'\n", e.overlay, newName)
+		return nil
+	})
+}
+
+// Reset discards the overlay's changes, optionally mounting it again afterwards
+func (e *Environment) Reset(ctx context.Context, opts ResetOptions) error {
+	return e.run(ctx, func(op *operation) error {
+		if err := e.requireOverlay(); err != nil {
+			return err
+		}
+
+		// Remember how the overlay is set up so that it can be remounted the same way
+		setupOpts := op.overlaySetupOptions(e.dir, e.overlay)
+
+		// The pristine overlay records the fingerprint of the mounted image base
+		if err := op.attachImageBase(e.dir); err != nil {
+			return err
+		}
+		defer op.detachImageBase(e.dir)
+
+		if err := op.resetOverlay(e.dir, e.overlay); err != nil {
+			return err
+		}
+
+		op.logf("Successfully reset overlay '%s' at %s\n", e.overlay, e.dir)
+
+		if opts.Remount {
+			return op.setupOverlayEnvironment(e.dir, e.overlay, setupOpts)
+		}
+		return nil
+	})
+}
+
+// Snapshot freezes the merged view of the overlay as a new versioned base,
+// and returns the directory of the new base
+func (e *Environment) Snapshot(ctx context.Context, version string) (string, error) {
+	var versionDir string
+	err := e.run(ctx, func(op *operation) error {
+		if err := e.requireOverlay(); err != nil {
+			return err
+		}
+
+		// The merged view reads through to the mounted image base
+		if err := op.attachImageBase(e.dir); err != nil {
+			return err
+		}
+		defer op.detachImageBase(e.dir)
+
+		var err error
+		if versionDir, err = op.snapshotOverlay(e.dir, e.overlay, version); err != nil {
+			return err
+		}
+
+		op.logf("Successfully created version '%s' from overlay '%s'\n", version, e.overlay)
+		return nil
+	})
+	return versionDir, err
+}
+
+// Flatten copies the merged view of the overlay into a new standalone base
+func (e *Environment) Flatten(ctx context.Context, destDir string) error {
+	absDest, err := filepath.Abs(destDir)
+	if err != nil {
+		return fmt.Errorf("failed to get absolute path: %w", err)
+	}
+
+	return e.run(ctx, func(op *operation) error {
+		if err := e.requireOverlay(); err != nil {
+			return err
+		}
+
+		// The merged view reads through to the mounted image base
+		if err := op.attachImageBase(e.dir); err != nil {
+			return err
+		}
+		defer op.detachImageBase(e.dir)
+
+		if err := op.validateOverlayStructure(e.dir, e.overlay); err != nil {
+			return err
+		}
+
+		if err := op.materializeOverlay(e.dir, e.overlay, absDest); err != nil {
+			return err
+		}
+
+		op.logf("Successfully flattened overlay '%s' into %s\n", e.overlay, absDest)
+		return nil
+	})
+}
+
+// Split creates the overlay on the base, holding the changes between the
+// base and a modified full copy of it
+func (e *Environment) Split(ctx context.Context, modifiedDir string) error {
+	absModified, err := filepath.Abs(modifiedDir)
+	if err != nil {
+		return fmt.Errorf("failed to get absolute path: %w", err)
+	}
+
+	return e.run(ctx, func(op *operation) error {
+		if err := e.requireOverlay(); err != nil {
+			return err
+		}
+
+		// The modified tree is compared against the mounted image base
+		if err := op.attachImageBase(e.dir); err != nil {
+			return err
+		}
+		defer op.detachImageBase(e.dir)
+
+		if err := op.splitEnvironment(e.dir, absModified, e.overlay); err != nil {
+			return err
+		}
+
+		op.logf("Successfully split %s into overlay '%s' of %s\n", absModified, e.overlay, e.dir)
+		return nil
+	})
+}
+
+// DiffStats counts the differences found between two overlays
+type DiffStats struct {
+	Added   int
+	Removed int
+	Changed int
+}
+
+// Diff compares the overlay with another overlay of the same base, writing
+// the differing paths to opts.Output
+func (e *Environment) Diff(ctx context.Context, againstName string, opts DiffOptions) (*DiffStats, error) {
+	var stats *DiffStats
+	err := e.run(ctx, func(op *operation) error {
+		if err := e.requireOverlay(); err != nil {
+			return err
+		}
+
+		if opts.Output != nil {
+			op.output = opts.Output
+		}
+
+		// The merged view reads through to the mounted image base
+		if err := op.attachImageBase(e.dir); err != nil {
+			return err
+		}
+		defer op.detachImageBase(e.dir)
+
+		var err error
+		stats, err = op.diffOverlays(e.dir, e.overlay, againstName, opts.Content)
+		return err
+	})
+	return stats, err
+}
+
+// CheckResult is the outcome of one preflight check
+type CheckResult struct {
+	Name string
+	// Err is nil when the check passed, and usually a *PreflightError saying
+	// how to fix the problem when it failed
+	Err error
+}
+
+// Check runs the preflight checks of the overlay, existing or not, and
+// returns the result of each. Overlays of backends that do not need
+// overlayfs have no checks.
+func (e *Environment) Check(ctx context.Context, opts CheckOptions) ([]CheckResult, error) {
+	var results []CheckResult
+	err := e.run(ctx, func(op *operation) error {
+		if err := e.requireOverlay(); err != nil {
+			return err
+		}
+
+		// The layout check resolves the mounted image base
+		if err := op.attachImageBase(e.dir); err != nil {
+			return err
+		}
+		defer op.detachImageBase(e.dir)
+
+		if !dirExists(op.getBaseRoot(e.dir)) {
+			return fmt.Errorf("base directory %s %w", op.getBaseRoot(e.dir), ErrNotExist)
+		}
+
+		// An existing overlay is checked with the options it is set up with
+		options := opts.MountOptions
+		meta, err := op.readOverlayMetadata(e.dir, e.overlay)
+		if err != nil {
+			return err
+		}
+		if meta != nil {
+			if backendName(meta) != BackendOverlay {
+				op.logf("Overlay '%s' uses the %s backend and does not need overlayfs\n", e.overlay, meta.Backend)
+				return nil
+			}
+			if len(options) > 0 && strings.Join(options, ",") != strings.Join(meta.Options, ",") {
+				return fmt.Errorf("overlay '%s' %w with mount options '%s'", e.overlay, ErrExist, strings.Join(meta.Options, ","))
+			}
+			options = meta.Options
+		}
+
+		// Size-limited overlays live on their storage image
+		if err := op.attachOverlayStorage(e.dir, e.overlay); err != nil {
+			return err
+		}
+
+		results = op.runPreflightChecks(e.dir, e.overlay, options)
+		failed := 0
+		for _, result := range results {
+			if result.Err != nil {
+				failed++
+			}
+		}
+
+		if failed > 0 {
+			return fmt.Errorf("%d of %d checks failed", failed, len(results))
+		}
+		return nil
+	})
+	return results, err
+}
+
+// Doctor finds state left inconsistent by crashes, such as stale mounts and
+// orphaned overlays, and repairs it when doctorOpts.Fix is set. The overlays
+// of the base at dir, if not empty, are scanned in addition to those in the
+// mount table and under opts.OverlayRoot. When fixing, the Err of each issue
+// is the error of its repair, and skipped issues are left as they are.
+func Doctor(ctx context.Context, dir string, doctorOpts DoctorOptions, opts Options) ([]Issue, error) {
+	env, err := newEnvironment(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if dir != "" {
+		if env.dir, err = filepath.Abs(dir); err != nil {
+			return nil, fmt.Errorf("failed to get absolute path: %w", err)
+		}
+	}
+
+	var issues []Issue
+	err = env.run(ctx, func(op *operation) error {
+		var err error
+		if issues, err = op.findDoctorIssues(env.dir, doctorOpts.DeleteOrphans); err != nil || !doctorOpts.Fix {
+			return err
+		}
+
+		failed, repairable := 0, 0
+		for i := range issues {
+			if issues[i].Skipped {
+				continue
+			}
+			repairable++
+			if issues[i].Err = issues[i].fix(); issues[i].Err != nil {
+				failed++
+			}
+		}
+
+		if failed > 0 {
+			return fmt.Errorf("%d of %d problem(s) could not be repaired", failed, repairable)
+		}
+		return nil
+	})
+	return issues, err
+}
+
+// Pack builds a squashfs or erofs image from the directory base
+func (e *Environment) Pack(ctx context.Context, image string, opts PackOptions) error {
+	absImage, err := filepath.Abs(image)
+	if err != nil {
+		return fmt.Errorf("failed to get absolute path: %w", err)
+	}
+
+	return e.run(ctx, func(op *operation) error {
+		if err := op.packBase(e.dir, absImage, opts.Format); err != nil {
+			return err
+		}
+
+		op.logf("Successfully packed %s into %s\n", e.dir, absImage)
+		return nil
+	})
+}
+
+// ImportOCI creates the base environment from a local OCI image layout
+func (e *Environment) ImportOCI(ctx context.Context, layoutDir string) error {
+	absLayout, err := filepath.Abs(layoutDir)
+	if err != nil {
+		return fmt.Errorf("failed to get absolute path: %w", err)
+	}
+
+	return e.run(ctx, func(op *operation) error {
+		created, err := prepareImportDir(e.dir)
+		if err != nil {
+			return err
+		}
+
+		if err := op.importOCILayout(absLayout, e.dir); err != nil {
+			// Don't leave a half-populated base behind
+			discardImportDir(e.dir, created)
+			return err
+		}
+
+		// Container images often lack the mountpoints needed by setup
+		if err := ensureChrootDirs(e.dir); err != nil {
+			return err
+		}
+
+		op.logf("Successfully imported %s into %s\n", absLayout, e.dir)
+		return nil
+	})
+}
+
+// ImportTar creates the base environment from a rootfs tarball
+func (e *Environment) ImportTar(ctx context.Context, archive string) error {
+	absArchive, err := filepath.Abs(archive)
+	if err != nil {
+		return fmt.Errorf("failed to get absolute path: %w", err)
+	}
+
+	return e.run(ctx, func(op *operation) error {
+		created, err := prepareImportDir(e.dir)
+		if err != nil {
+			return err
+		}
+
+		if err := op.importRootfsTar(absArchive, e.dir); err != nil {
+			// Don't leave a half-populated base behind
+			discardImportDir(e.dir, created)
+			return err
+		}
+
+		if err := ensureChrootDirs(e.dir); err != nil {
+			return err
+		}
+
+		op.logf("Successfully imported %s into %s\n", absArchive, e.dir)
+		return nil
+	})
+}
+
+// Export writes the base environment into a rootfs tarball
+func (e *Environment) Export(ctx context.Context, archive string) error {
+	absArchive, err := filepath.Abs(archive)
+	if err != nil {
+		return fmt.Errorf("failed to get absolute path: %w", err)
+	}
+
+	return e.run(ctx, func(op *operation) error {
+		if err := validateChrootStructure(e.dir); err != nil {
+			return err
+		}
+
+		// Never archive the contents of /proc, /dev or /sys
+		if err := op.validateNotMounted(e.dir); err != nil {
+			return err
+		}
+
+		if strings.HasPrefix(absArchive, e.dir+string(filepath.Separator)) {
+			return fmt.Errorf("archive %s must not be inside %s", absArchive, e.dir)
+		}
+
+		if err := op.exportRootfsTar(e.dir, absArchive); err != nil {
+			return err
+		}
+
+		op.logf("Successfully exported %s to %s\n", e.dir, absArchive)
+		return nil
+	})
+}
+
+// prepareImportDir makes sure the import target is a new or empty directory
+func prepareImportDir(chrootDir string) (created bool, err error) {
+	if !pathExists(chrootDir) {
+		if err := ensureDir(chrootDir, 0755); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+
+	if !dirExists(chrootDir) {
+		return false, fmt.Errorf("%s exists and is not a directory", chrootDir)
+	}
+
+	entries, err := os.ReadDir(chrootDir)
+	if err != nil {
+		return false, fmt.Errorf("failed to read %s: %w", chrootDir, err)
+	}
+
+	if len(entries) > 0 {
+		return false, fmt.Errorf("chroot directory %s is not empty", chrootDir)
+	}
+
+	return false, nil
+}
+
+// discardImportDir removes what a failed import left in a base directory,
+// which was empty or created by prepareImportDir
+func discardImportDir(chrootDir string, created bool) {
+	if created {
+		os.RemoveAll(chrootDir)
+		return
+	}
+	emptyDir(chrootDir)
+}
+
+// setupNormalEnvironment sets up a normal chroot environment
+func (op *operation) setupNormalEnvironment(chrootDir string) error {
+	// Validate directory exists
+	if err := validateChrootStructure(chrootDir); err != nil {
+		return err
+	}
+
+	// The essential filesystems of a read-only setup cannot be reused
+	if op.isReadOnlyBindMount(chrootDir) {
+		return fmt.Errorf("base %s is set up read-only, cleanup it first to set it up writable", chrootDir)
+	}
+
+	// Changing the base underneath mounted overlays corrupts them
+	if mounted := op.findMountedOverlays(chrootDir); len(mounted) > 0 {
+		return fmt.Errorf("base %s is %w by mounted overlays %s, cleanup them first or use -readonly", chrootDir, ErrInUse, strings.Join(mounted, ", "))
+	}
+
+	if overlays := op.findOverlays(chrootDir); len(overlays) > 0 {
+		op.logf("Warning: base %s has overlays %s, changes to the base will show through in them\n", chrootDir, strings.Join(overlays, ", "))
+	}
+
+	// Mount essential filesystems
+	if err := op.mountEssentialFS(chrootDir, false); err != nil {
+		// Cleanup on failure
+		op.umountEssentialFS(chrootDir)
+		return fmt.Errorf("failed to mount filesystems: %w", err)
+	}
+
+	// Setup resolv.conf
+	if err := setupResolvConf(chrootDir); err != nil {
+		// Cleanup on failure
+		op.umountEssentialFS(chrootDir)
+		return fmt.Errorf("failed to setup resolv.conf: %w", err)
+	}
+
+	op.logf("Successfully set up chroot environment at %s\n", chrootDir)
+	return nil
+}
+
+// setupReadOnlyEnvironment bind mounts a normal chroot environment read-only for inspection
+func (op *operation) setupReadOnlyEnvironment(chrootDir string) error {
+	// Validate directory exists
+	if err := validateChrootStructure(chrootDir); err != nil {
+		return err
+	}
+
+	// A writable setup would be hidden underneath the read-only bind
+	if !op.isReadOnlyBindMount(chrootDir) {
+		if err := op.validateNotMounted(chrootDir); err != nil {
+			return err
+		}
+
+		if err := op.bindMountReadOnly(chrootDir, chrootDir); err != nil {
+			return err
+		}
+	}
+
+	// Mount essential filesystems on top of the read-only bind
+	if err := op.mountEssentialFS(chrootDir, true); err != nil {
+		// Cleanup on failure
+		op.umountEssentialFS(chrootDir)
+		op.umountPath(chrootDir)
+		return fmt.Errorf("failed to mount filesystems: %w", err)
+	}
+
+	// resolv.conf cannot be written to a read-only environment
+	op.logf("Successfully set up read-only chroot environment at %s\n", chrootDir)
+	return nil
+}
+
+// setupOverlayEnvironment sets up an overlay chroot environment with named overlay
+func (op *operation) setupOverlayEnvironment(chrootDir string, overlayName string, opts SetupOptions) error {
+	// Validate base directory exists
+	if err := validateChrootStructure(op.getBaseRoot(chrootDir)); err != nil {
+		return err
+	}
+
+	// Check if this specific overlay is already set up
+	_, _, merged := op.getOverlayPaths(chrootDir, overlayName)
+	mounted := op.isOverlaySetup(chrootDir, overlayName)
+	if mounted && !opts.Ensure {
+		return fmt.Errorf("overlay '%s' is %w at %s", overlayName, ErrAlreadySetUp, chrootDir)
+	}
+
+	// An existing setup is completed in place, it must be of the requested kind
+	if mounted {
+		if err := op.checkExistingSetup(chrootDir, overlayName, opts); err != nil {
+			return err
+		}
+	}
+
+	// A size-limited overlay keeps its layers and metadata on a storage image
+	if opts.Quota != "" {
+		if !op.isQuotaOverlay(chrootDir, overlayName) {
+			if opts.ReadOnly && !dirExists(op.getOverlayDir(chrootDir, overlayName)) {
+				return fmt.Errorf("overlay '%s' %w at %s, a read-only setup cannot create it", overlayName, ErrNotExist, chrootDir)
+			}
+			return op.setupQuotaOverlayEnvironment(chrootDir, overlayName, opts)
+		}
+		if err := op.setupQuotaImage(chrootDir, overlayName, opts.Quota); err != nil {
+			return err
+		}
+	}
+
+	if err := op.attachOverlayStorage(chrootDir, overlayName); err != nil {
+		return err
+	}
+
+	// Load the recorded parent chain, or create it for a new overlay
+	meta, err := op.loadSetupMetadata(chrootDir, overlayName, opts)
+	if err != nil {
+		if !mounted {
+			op.releaseOverlayStorage(chrootDir, overlayName)
+		}
+		return err
+	}
+
+	backend, err := op.getBackend(meta.Backend)
+	if err != nil {
+		if !mounted {
+			op.releaseOverlayStorage(chrootDir, overlayName)
+		}
+		return err
+	}
+
+	// Versions are immutable, the layers of an overlay on one must not be
+	// able to change underneath it
+	if backendName(meta) == BackendOverlay && isVersionBase(chrootDir) {
+		opts.ProtectBase = true
+	}
+
+	// Release the storage, including that of the parents of a new overlay
+	// which has no metadata yet, and the base protection unless it was
+	// there before
+	protected := op.isReadOnlyBindMount(chrootDir)
+	release := func() {
+		backend.Release(chrootDir, overlayName)
+		for _, parent := range meta.Parents {
+			op.releaseOverlayStorage(chrootDir, parent)
+		}
+		if !protected {
+			op.releaseBaseProtection(chrootDir)
+		}
+	}
+
+	// Create the overlay's storage, or check that of an existing overlay, and
+	// mount its root filesystem at merged. A mounted overlay already has
+	// them, and its base must not be checked or protected again.
+	if !mounted {
+		if err := backend.Prepare(chrootDir, meta, opts); err != nil {
+			release()
+			return err
+		}
+
+		if err := op.writeOverlayMetadata(chrootDir, meta); err != nil {
+			release()
+			return err
+		}
+
+		if err := backend.Mount(chrootDir, meta, opts.ReadOnly); err != nil {
+			release()
+			return err
+		}
+	}
+
+	// Only undo what this setup mounted, an earlier setup is left as it was
+	rollback := func() {
+		if !mounted {
+			op.umountEssentialFS(merged)
+			backend.Unmount(chrootDir, overlayName)
+			release()
+		}
+	}
+
+	// Mount essential filesystems on merged directory, skipping those already mounted
+	if err := op.mountEssentialFS(merged, opts.ReadOnly); err != nil {
+		// Cleanup on failure
+		rollback()
+		return fmt.Errorf("failed to mount essential filesystems: %w", err)
+	}
+
+	overlayDir := op.getOverlayDir(chrootDir, overlayName)
+	if opts.ReadOnly {
+		op.logf("Successfully set up read-only overlay chroot environment\n")
+		op.logf("Base: %s\n", chrootDir)
+		op.logf("Overlay: %s\n", overlayDir)
+		op.logf("Use: sudo chroot %s\n", merged)
+		return nil
+	}
+
+	// Setup resolv.conf in merged directory
+	if err := setupResolvConf(merged); err != nil {
+		// Cleanup on failure
+		rollback()
+		return fmt.Errorf("failed to setup resolv.conf: %w", err)
+	}
+
+	op.logf("Successfully set up overlay chroot environment\n")
+	op.logf("Base: %s\n", chrootDir)
+	op.logf("Overlay: %s\n", overlayDir)
+	op.logf("Use: sudo chroot %s\n", merged)
+	return nil
+}
+
+// checkExistingSetup checks that a mounted overlay is set up the way it is
+// requested: writable or read-only, on the same storage, and with the base
+// protected when asked for
+func (op *operation) checkExistingSetup(chrootDir string, overlayName string, opts SetupOptions) error {
+	_, _, merged := op.getOverlayPaths(chrootDir, overlayName)
+	if op.isReadOnlyMount(merged) != opts.ReadOnly {
+		if opts.ReadOnly {
+			return fmt.Errorf("overlay '%s' is set up writable, cleanup it first to set it up read-only", overlayName)
+		}
+		return fmt.Errorf("overlay '%s' is set up read-only, cleanup it first to set it up writable", overlayName)
+	}
+
+	tmpfs := op.isTmpfsOverlay(chrootDir, overlayName)
+	switch {
+	case opts.Tmpfs && !tmpfs:
+		return fmt.Errorf("overlay '%s' is set up on disk, cleanup it first to set it up on a tmpfs", overlayName)
+	case !opts.Tmpfs && tmpfs:
+		return fmt.Errorf("overlay '%s' is set up on a tmpfs, cleanup it first to set it up on disk", overlayName)
+	case opts.Tmpfs && opts.TmpfsSize != "":
+		// The kernel reports the size in kilobytes, sizes relative to the
+		// memory are not compared
+		want, err := parseSize(opts.TmpfsSize)
+		if err != nil {
+			break
+		}
+		mount := op.findMount(op.getOverlayDir(chrootDir, overlayName))
+		if size, err := parseSize(mountOption(mount.SuperOptions, "size")); err != nil || size != want {
+			return fmt.Errorf("overlay '%s' is set up on a tmpfs of another size, cleanup it first to resize it", overlayName)
+		}
+	}
+
+	if opts.Quota != "" && !op.isQuotaOverlay(chrootDir, overlayName) {
+		return fmt.Errorf("overlay '%s' %w without a quota", overlayName, ErrExist)
+	}
+
+	if opts.ProtectBase && !op.isReadOnlyBindMount(chrootDir) {
+		return fmt.Errorf("overlay '%s' is set up without base protection, cleanup it first to protect the base", overlayName)
+	}
+
+	return nil
+}
+
+// loadSetupMetadata returns the recorded metadata of an overlay being set
+// up, checked against the setup options, or creates it for a new overlay
+func (op *operation) loadSetupMetadata(chrootDir string, overlayName string, opts SetupOptions) (*OverlayMetadata, error) {
+	meta, err := op.readOverlayMetadata(chrootDir, overlayName)
+	if err != nil {
+		return nil, err
+	}
+
+	// Overlays created before metadata was kept have their upper layer
+	upper, _, _ := op.getOverlayPaths(chrootDir, overlayName)
+
+	switch {
+	case meta == nil && opts.ReadOnly && !dirExists(upper):
+		return nil, fmt.Errorf("overlay '%s' %w at %s, a read-only setup cannot create it", overlayName, ErrNotExist, chrootDir)
+	case meta == nil:
+		meta, err = op.newOverlayMetadata(chrootDir, overlayName, opts.From, opts.MountOptions)
+		if err != nil {
+			return nil, err
+		}
+		if opts.Backend != "" {
+			meta.Backend = opts.Backend
+		}
+		if err := op.selectOverlayBackend(chrootDir, meta, opts); err != nil {
+			return nil, err
+		}
+	case meta.Base != chrootDir:
+		return nil, fmt.Errorf("overlay directory %s belongs to base %s", op.getOverlayDir(chrootDir, overlayName), meta.Base)
+	case opts.From != "" && (len(meta.Parents) == 0 || meta.Parents[0] != opts.From):
+		return nil, fmt.Errorf("overlay '%s' %w and is not stacked on '%s'", overlayName, ErrExist, opts.From)
+	case len(opts.MountOptions) > 0 && strings.Join(opts.MountOptions, ",") != strings.Join(meta.Options, ","):
+		return nil, fmt.Errorf("overlay '%s' %w with mount options '%s'", overlayName, ErrExist, strings.Join(meta.Options, ","))
+	case opts.Backend != "" && opts.Backend != backendName(meta):
+		return nil, fmt.Errorf("overlay '%s' %w with the %s backend", overlayName, ErrExist, backendName(meta))
+	}
+
+	return meta, nil
+}
+
+// selectOverlayBackend checks that overlayfs can be mounted for a new
+// overlay using the overlay backend, falling back to the copy backend when
+// allowed. Overlays on a tmpfs or a storage image keep their upper layer
+// elsewhere, and are left to fail at mount time.
+func (op *operation) selectOverlayBackend(chrootDir string, meta *OverlayMetadata, opts SetupOptions) error {
+	if backendName(meta) != BackendOverlay || opts.Tmpfs || opts.Quota != "" {
+		return nil
+	}
+
+	err := op.probeOverlayFS(filepath.Dir(op.getOverlayDir(chrootDir, meta.Name)))
+	if err == nil {
+		return nil
+	}
+
+	if !opts.AllowCopy {
+		return fmt.Errorf("overlayfs cannot be mounted here (%v), use -allow-copy to fall back to a copy of the base", err)
+	}
+
+	op.logf("Warning: overlayfs cannot be mounted here (%v), using the copy backend\n", err)
+	meta.Backend = BackendCopy
+	return nil
+}
+
+// setupImageOverlayEnvironment sets up an overlay on an image base, which is
+// mounted read-only at a managed location to serve as the lowest layer
+func (op *operation) setupImageOverlayEnvironment(chrootDir string, overlayName string, opts SetupOptions) error {
+	if opts.ProtectBase {
+		return fmt.Errorf("image base %s is always mounted read-only", chrootDir)
+	}
+
+	if err := op.attachImageBase(chrootDir); err != nil {
+		return err
+	}
+
+	if err := op.setupOverlayEnvironment(chrootDir, overlayName, opts); err != nil {
+		op.detachImageBase(chrootDir)
+		return err
+	}
+
+	return nil
+}
+
+// cleanupNormalEnvironment cleans up a normal chroot environment
+func (op *operation) cleanupNormalEnvironment(chrootDir string) error {
+	// Check if it's actually a normal environment
+	if !dirExists(chrootDir) {
+		return fmt.Errorf("chroot directory %s %w", chrootDir, ErrNotExist)
+	}
+
+	// Check before unmounting anything
+	readOnly := op.isReadOnlyBindMount(chrootDir)
+
+	// Unmount essential filesystems
+	if err := op.umountEssentialFS(chrootDir); err != nil {
+		return fmt.Errorf("failed to unmount filesystems: %w", err)
+	}
+
+	if readOnly {
+		// Remove the read-only bind unless it protects the base for mounted overlays
+		if err := op.releaseBaseProtection(chrootDir); err != nil {
+			return err
+		}
+	} else if err := cleanupResolvConf(chrootDir); err != nil {
+		// Non-critical error, just warn
+		op.logf("Warning: failed to cleanup resolv.conf: %v\n", err)
+	}
+
+	op.logf("Successfully cleaned up chroot environment at %s\n", chrootDir)
+	return nil
+}
+
+// cleanupOverlayEnvironment cleans up a specific overlay chroot environment
+func (op *operation) cleanupOverlayEnvironment(chrootDir string, overlayName string) error {
+	_, _, merged := op.getOverlayPaths(chrootDir, overlayName)
+
+	// Check if overlay exists
+	overlayDir := op.getOverlayDir(chrootDir, overlayName)
+	if !dirExists(overlayDir) {
+		return fmt.Errorf("overlay '%s' %w at %s", overlayName, ErrNotExist, chrootDir)
+	}
+
+	// Unmount essential filesystems from merged directory
+	if err := op.umountEssentialFS(merged); err != nil {
+		op.logf("Warning: failed to unmount essential filesystems: %v\n", err)
+	}
+
+	// Cleanup resolv.conf from merged directory, unless it was mounted read-only
+	if !op.isReadOnlyMount(merged) {
+		if err := cleanupResolvConf(merged); err != nil {
+			op.logf("Warning: failed to cleanup resolv.conf: %v\n", err)
+		}
+	}
+
+	// Unmount overlay
+	backend := op.getOverlayBackend(chrootDir, overlayName)
+	if err := backend.Unmount(chrootDir, overlayName); err != nil {
+		return fmt.Errorf("failed to unmount overlay: %w", err)
+	}
+
+	// Release the overlay's storage, which discards the contents of a tmpfs
+	if err := backend.Release(chrootDir, overlayName); err != nil {
+		return fmt.Errorf("failed to unmount overlay storage: %w", err)
+	}
+
+	// Make the base writable again when this was the last mounted overlay
+	if err := op.releaseBaseProtection(chrootDir); err != nil {
+		op.logf("Warning: %v\n", err)
+	}
+
+	op.logf("Successfully cleaned up overlay '%s' at %s\n", overlayName, chrootDir)
+	return nil
+}
+
+// removeSpecificOverlay removes only a specific overlay directory
+func (op *operation) removeSpecificOverlay(chrootDir string, overlayName string, force bool) error {
+	overlayDir := op.getOverlayDir(chrootDir, overlayName)
+
+	// Check if overlay exists
+	if !dirExists(overlayDir) && !op.isQuotaOverlay(chrootDir, overlayName) {
+		return fmt.Errorf("overlay '%s' %w at %s", overlayName, ErrNotExist, chrootDir)
+	}
+
+	// Stacked overlays would lose one of their lower layers
+	dependents, err := op.findDependentOverlays(chrootDir, overlayName)
+	if err != nil {
+		return err
+	}
+	if len(dependents) > 0 {
+		return fmt.Errorf("overlay '%s' is %w by %s, remove them first", overlayName, ErrInUse, strings.Join(dependents, ", "))
+	}
+
+	// Check before cleanup, which unmounts the tmpfs
+	ephemeral := op.isTmpfsOverlay(chrootDir, overlayName)
+	backend := op.getOverlayBackend(chrootDir, overlayName)
+
+	// Try to cleanup first
+	if err := op.cleanupOverlayEnvironment(chrootDir, overlayName); err != nil && !force {
+		return fmt.Errorf("failed to cleanup before removal: %w", err)
+	}
+
+	// Remove the backend storage, then the overlay directory
+	if err := backend.Delete(chrootDir, overlayName); err != nil {
+		return fmt.Errorf("failed to remove overlay storage: %w", err)
+	}
+
+	if err := op.deleteOverlayDir(overlayDir, ephemeral); err != nil {
+		return fmt.Errorf("failed to remove overlay directory: %w", err)
+	}
+
+	op.logf("Successfully removed overlay '%s'\n", overlayName)
+	op.logf("Base directory %s is preserved\n", chrootDir)
+	return nil
+}
+
+// removeAll removes base and all overlays
+func (op *operation) removeAll(chrootDir string, force bool) error {
+	// Find and remove all overlays
+	if err := op.removeAllOverlays(chrootDir, force); err != nil && !force {
+		return err
+	}
+
+	// Remove base directory if it exists
+	if err := op.removeBaseDirectory(chrootDir, force); err != nil {
+		return err
+	}
+
+	op.logf("Successfully removed all environments\n")
+	return nil
+}
+
+// removeAllOverlays finds and removes all overlay directories for a base
+func (op *operation) removeAllOverlays(chrootDir string, force bool) error {
+	overlays := op.findOverlays(chrootDir)
+
+	// Remove stacked overlays before the overlays they depend on
+	depth := make(map[string]int)
+	for _, name := range overlays {
+		if meta, err := op.readOverlayMetadata(chrootDir, name); err == nil && meta != nil {
+			depth[name] = len(meta.Parents)
+		}
+	}
+	sort.SliceStable(overlays, func(i, j int) bool {
+		return depth[overlays[i]] > depth[overlays[j]]
+	})
+
+	for _, overlayName := range overlays {
+		if err := op.removeOverlayDirectory(chrootDir, overlayName, force); err != nil && !force {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// removeOverlayDirectory removes a single overlay directory
+func (op *operation) removeOverlayDirectory(chrootDir, overlayName string, force bool) error {
+	// Check before cleanup, which unmounts the tmpfs
+	ephemeral := op.isTmpfsOverlay(chrootDir, overlayName)
+	backend := op.getOverlayBackend(chrootDir, overlayName)
+
+	// Try to cleanup first
+	if err := op.cleanupOverlayEnvironment(chrootDir, overlayName); err != nil && !force {
+		op.logf("Warning: failed to cleanup overlay '%s': %v\n", overlayName, err)
+	}
+
+	// Remove the backend storage, then the overlay directory
+	if err := backend.Delete(chrootDir, overlayName); err != nil && !force {
+		op.logf("Warning: failed to remove storage of overlay '%s': %v\n", overlayName, err)
+		return err
+	}
+
+	overlayPath := op.getOverlayDir(chrootDir, overlayName)
+	if err := op.deleteOverlayDir(overlayPath, ephemeral); err != nil && !force {
+		op.logf("Warning: failed to remove overlay '%s': %v\n", overlayName, err)
+		return err
+	}
+
+	op.logf("Removed overlay: %s\n", overlayName)
+	return nil
+}
+
+// removeBaseDirectory removes the base chroot directory
+func (op *operation) removeBaseDirectory(chrootDir string, force bool) error {
+	if isImageBase(chrootDir) {
+		return op.removeBaseImage(chrootDir)
+	}
+
+	if !dirExists(chrootDir) {
+		return nil
+	}
+
+	// Try to cleanup as normal environment
+	if err := op.cleanupNormalEnvironment(chrootDir); err != nil && !force {
+		op.logf("Warning: failed to cleanup base: %v\n", err)
+	}
+
+	// Remove base directory
+	if err := os.RemoveAll(chrootDir); err != nil {
+		return fmt.Errorf("failed to remove base directory: %w", err)
+	}
+
+	// Remove the lineage of a versioned base
+	if strings.Contains(filepath.Base(chrootDir), VersionSeparator) {
+		if err := removeIfExists(getLineagePath(chrootDir)); err != nil {
+			op.logf("Warning: failed to remove lineage: %v\n", err)
+		}
+	}
+
+	op.logf("Removed base directory: %s\n", chrootDir)
+	return nil
+}
+
+// removeBaseImage detaches and deletes an image base
+func (op *operation) removeBaseImage(chrootDir string) error {
+	if err := op.detachImageBase(chrootDir); err != nil {
+		return fmt.Errorf("failed to detach image base: %w", err)
+	}
+
+	if err := os.Remove(chrootDir); err != nil {
+		return fmt.Errorf("failed to remove base image: %w", err)
+	}
+
+	op.logf("Removed base image: %s\n", chrootDir)
+	return nil
+}
@@ -0,0 +1,1042 @@
+package chrootprep
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"syscall"
+	"testing"
+)
+
+// testLogger sends progress messages to the test log
+type testLogger struct {
+	t *testing.T
+}
+
+func (l testLogger) Printf(format string, v ...any) {
+	l.t.Helper()
+	l.t.Logf(format, v...)
+}
+
+// newTestBase creates a minimal base environment in a temporary directory
+func newTestBase(t *testing.T) string {
+	t.Helper()
+
+	base := filepath.Join(t.TempDir(), "base")
+	for _, dir := range []string{"dev", "proc", "sys", "etc", "bin"} {
+		if err := os.MkdirAll(filepath.Join(base, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(base, "etc", "hostname"), []byte("base\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return base
+}
+
+// newTestImage creates an image base, whose files are those of a test base
+// once a fake mounter is told about them
+func newTestImage(t *testing.T) (image string, files string) {
+	t.Helper()
+
+	// The superblock magic is all that identifies a squashfs image
+	header := make([]byte, 2048)
+	copy(header, "hsqs")
+	image = filepath.Join(t.TempDir(), "base.squashfs")
+	if err := os.WriteFile(image, header, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return image, newTestBase(t)
+}
+
+// newTestEnvironment returns an environment of base mounted through a fake
+// mounter, whose preflight checks pass without probing the host
+func newTestEnvironment(t *testing.T, base string, overlayName string) (*Environment, *FakeMounter) {
+	t.Helper()
+
+	mounter := NewFakeMounter()
+	env, err := New(base, overlayName, Options{
+		Logger:         testLogger{t},
+		Mounter:        mounter,
+		ImageMountRoot: filepath.Join(t.TempDir(), "bases"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	env.preflightChecks = stubPreflightChecks(nil)
+
+	return env, mounter
+}
+
+// stubPreflightChecks returns the preflight checks, each replaced by a
+// check returning err
+func stubPreflightChecks(err error) []preflightCheck {
+	checks := slices.Clone(preflightChecks)
+	for i := range checks {
+		checks[i].run = func(op *operation, chrootDir string, overlayName string, options []string) error {
+			return err
+		}
+	}
+	return checks
+}
+
+// mountpoints returns the mountpoints of the fake mount table, in mount order
+func mountpoints(t *testing.T, mounter *FakeMounter) []string {
+	t.Helper()
+
+	mounts, err := mounter.MountInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var paths []string
+	for _, mount := range mounts {
+		paths = append(paths, mount.MountPoint)
+	}
+	return paths
+}
+
+// essentialMounts returns the mountpoints setup creates in dir, in mount order
+func essentialMounts(dir string) []string {
+	return []string{filepath.Join(dir, "proc"), filepath.Join(dir, "dev"), filepath.Join(dir, "sys")}
+}
+
+func TestSetupAndCleanupNormal(t *testing.T) {
+	ctx := context.Background()
+	base := newTestBase(t)
+	env, mounter := newTestEnvironment(t, base, "")
+
+	if err := env.Setup(ctx, SetupOptions{}); err != nil {
+		t.Fatalf("Setup: %v", err)
+	}
+	if got, want := mountpoints(t, mounter), essentialMounts(base); !slices.Equal(got, want) {
+		t.Errorf("mounts after Setup = %v, want %v", got, want)
+	}
+	if !fileExists(filepath.Join(base, resolvConfName)) {
+		t.Errorf("resolv.conf was not set up")
+	}
+
+	if err := env.Cleanup(ctx); err != nil {
+		t.Fatalf("Cleanup: %v", err)
+	}
+	if got := mountpoints(t, mounter); len(got) != 0 {
+		t.Errorf("mounts after Cleanup = %v, want none", got)
+	}
+	if fileExists(filepath.Join(base, resolvConfName)) {
+		t.Errorf("resolv.conf was not cleaned up")
+	}
+}
+
+func TestSetupNormalRollback(t *testing.T) {
+	base := newTestBase(t)
+	env, mounter := newTestEnvironment(t, base, "")
+	mounter.Fail[filepath.Join(base, "sys")] = syscall.EPERM
+
+	if err := env.Setup(context.Background(), SetupOptions{}); !errors.Is(err, syscall.EPERM) {
+		t.Fatalf("Setup error = %v, want EPERM", err)
+	}
+	if got := mountpoints(t, mounter); len(got) != 0 {
+		t.Errorf("mounts after failed Setup = %v, want none", got)
+	}
+}
+
+func TestSetupMissingBase(t *testing.T) {
+	env, _ := newTestEnvironment(t, filepath.Join(t.TempDir(), "missing"), "")
+
+	if err := env.Setup(context.Background(), SetupOptions{}); !errors.Is(err, ErrNotExist) {
+		t.Errorf("Setup error = %v, want ErrNotExist", err)
+	}
+}
+
+func TestSetupOverlay(t *testing.T) {
+	ctx := context.Background()
+	base := newTestBase(t)
+	env, mounter := newTestEnvironment(t, base, "dev")
+	op := env.newOperation(context.Background())
+	_, _, merged := op.getOverlayPaths(base, "dev")
+
+	if err := env.Setup(ctx, SetupOptions{}); err != nil {
+		t.Fatalf("Setup: %v", err)
+	}
+
+	want := append([]string{merged}, essentialMounts(merged)...)
+	if got := mountpoints(t, mounter); !slices.Equal(got, want) {
+		t.Errorf("mounts after Setup = %v, want %v", got, want)
+	}
+	if !fileExists(filepath.Join(merged, "etc", "hostname")) {
+		t.Errorf("merged view does not show the base")
+	}
+	if !fileExists(filepath.Join(merged, resolvConfName)) {
+		t.Errorf("resolv.conf was not set up in the merged view")
+	}
+	if fileExists(filepath.Join(base, resolvConfName)) {
+		t.Errorf("resolv.conf was written to the base")
+	}
+	if meta, err := op.readOverlayMetadata(base, "dev"); err != nil || meta == nil || meta.Base != base {
+		t.Errorf("metadata = %+v, %v, want an overlay of %s", meta, err, base)
+	}
+
+	if err := env.Setup(ctx, SetupOptions{}); !errors.Is(err, ErrAlreadySetUp) {
+		t.Errorf("second Setup error = %v, want ErrAlreadySetUp", err)
+	}
+}
+
+func TestSetupOverlayPreflightFailure(t *testing.T) {
+	base := newTestBase(t)
+	env, mounter := newTestEnvironment(t, base, "dev")
+	env.preflightChecks = stubPreflightChecks(&PreflightError{Check: "upper filesystem", Err: ErrUnsupportedUpper})
+
+	if err := env.Setup(context.Background(), SetupOptions{}); !errors.Is(err, ErrUnsupportedUpper) {
+		t.Fatalf("Setup error = %v, want ErrUnsupportedUpper", err)
+	}
+	if got := mountpoints(t, mounter); len(got) != 0 {
+		t.Errorf("mounts after failed Setup = %v, want none", got)
+	}
+}
+
+func TestSetupReadOnlyMissingOverlay(t *testing.T) {
+	base := newTestBase(t)
+	env, mounter := newTestEnvironment(t, base, "ro")
+	op := env.newOperation(context.Background())
+
+	for _, opts := range []SetupOptions{{ReadOnly: true}, {ReadOnly: true, Quota: "16M"}} {
+		if err := env.Setup(context.Background(), opts); !errors.Is(err, ErrNotExist) {
+			t.Errorf("Setup with %+v error = %v, want ErrNotExist", opts, err)
+		}
+	}
+	if got := mountpoints(t, mounter); len(got) != 0 {
+		t.Errorf("mounts after failed Setup = %v, want none", got)
+	}
+	if pathExists(op.getOverlayDir(base, "ro")) || pathExists(op.getQuotaImagePath(base, "ro")) {
+		t.Errorf("failed read-only Setup created the overlay")
+	}
+}
+
+func TestSetupOverlayEnsure(t *testing.T) {
+	ctx := context.Background()
+	base := newTestBase(t)
+	env, mounter := newTestEnvironment(t, base, "dev")
+	op := env.newOperation(context.Background())
+	_, _, merged := op.getOverlayPaths(base, "dev")
+
+	if err := env.Setup(ctx, SetupOptions{}); err != nil {
+		t.Fatalf("Setup: %v", err)
+	}
+
+	// Complete a setup missing one of its mounts
+	if err := mounter.Unmount(filepath.Join(merged, "proc"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := env.Setup(ctx, SetupOptions{Ensure: true}); err != nil {
+		t.Fatalf("Setup with Ensure: %v", err)
+	}
+	if got := mountpoints(t, mounter); len(got) != 4 || !mounter.IsMountPoint(filepath.Join(merged, "proc")) {
+		t.Errorf("mounts after Setup with Ensure = %v, want the overlay and its 3 filesystems", got)
+	}
+
+	if err := env.Setup(ctx, SetupOptions{Ensure: true, ReadOnly: true}); err == nil {
+		t.Errorf("Setup with Ensure of a writable overlay as read-only succeeded")
+	}
+}
+
+func TestSetupOverlayEnsureMismatch(t *testing.T) {
+	ctx := context.Background()
+	base := newTestBase(t)
+	env, mounter := newTestEnvironment(t, base, "tmp")
+
+	if err := env.Setup(ctx, SetupOptions{Tmpfs: true, TmpfsSize: "64M"}); err != nil {
+		t.Fatalf("Setup: %v", err)
+	}
+	want := mountpoints(t, mounter)
+
+	for _, opts := range []SetupOptions{
+		{Ensure: true},
+		{Ensure: true, Tmpfs: true, TmpfsSize: "128M"},
+		{Ensure: true, Tmpfs: true, ProtectBase: true},
+	} {
+		if err := env.Setup(ctx, opts); err == nil {
+			t.Errorf("Setup with %+v of a mismatching overlay succeeded", opts)
+		}
+	}
+
+	if err := env.Setup(ctx, SetupOptions{Ensure: true, Tmpfs: true, TmpfsSize: "64M"}); err != nil {
+		t.Errorf("Setup with Ensure of a matching overlay: %v", err)
+	}
+	if got := mountpoints(t, mounter); !slices.Equal(got, want) {
+		t.Errorf("mounts after Setup with Ensure = %v, want %v", got, want)
+	}
+}
+
+func TestSetupOverlayEnsureSkipsBaseChecks(t *testing.T) {
+	ctx := context.Background()
+	base := newTestBase(t)
+	env, _ := newTestEnvironment(t, base, "dev")
+
+	if err := env.Setup(ctx, SetupOptions{}); err != nil {
+		t.Fatalf("Setup: %v", err)
+	}
+
+	// Completing the setup of a mounted overlay does not check its base for drift
+	if err := os.WriteFile(filepath.Join(base, "etc", "hostname"), []byte("changed\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := env.Setup(ctx, SetupOptions{Ensure: true}); err != nil {
+		t.Errorf("Setup with Ensure of a mounted overlay: %v", err)
+	}
+}
+
+func TestSetupOverlayRollback(t *testing.T) {
+	base := newTestBase(t)
+	env, mounter := newTestEnvironment(t, base, "dev")
+	op := env.newOperation(context.Background())
+	_, _, merged := op.getOverlayPaths(base, "dev")
+	mounter.Fail[filepath.Join(merged, "sys")] = syscall.EPERM
+
+	if err := env.Setup(context.Background(), SetupOptions{}); !errors.Is(err, syscall.EPERM) {
+		t.Fatalf("Setup error = %v, want EPERM", err)
+	}
+	if got := mountpoints(t, mounter); len(got) != 0 {
+		t.Errorf("mounts after failed Setup = %v, want none", got)
+	}
+	if entries, _ := os.ReadDir(merged); len(entries) != 0 {
+		t.Errorf("merged directory is not empty after failed Setup")
+	}
+}
+
+func TestSetupProtectedOverlayRollback(t *testing.T) {
+	ctx := context.Background()
+	base := newTestBase(t)
+	env, mounter := newTestEnvironment(t, base, "dev")
+	op := env.newOperation(ctx)
+	_, _, merged := op.getOverlayPaths(base, "dev")
+
+	// Failing while mounting the overlay, and while preparing its storage
+	mounter.Fail[filepath.Join(merged, "sys")] = syscall.EPERM
+	if err := env.Setup(ctx, SetupOptions{ProtectBase: true}); !errors.Is(err, syscall.EPERM) {
+		t.Fatalf("Setup error = %v, want EPERM", err)
+	}
+	if got := mountpoints(t, mounter); len(got) != 0 {
+		t.Errorf("mounts after failed Setup = %v, want none", got)
+	}
+
+	mounter.Fail[op.getOverlayDir(base, "tmp")] = syscall.ENOMEM
+	tmp, err := env.WithOverlay("tmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tmp.Setup(ctx, SetupOptions{ProtectBase: true, Tmpfs: true}); !errors.Is(err, syscall.ENOMEM) {
+		t.Fatalf("Setup on a tmpfs error = %v, want ENOMEM", err)
+	}
+	if got := mountpoints(t, mounter); len(got) != 0 {
+		t.Errorf("mounts after failed Setup on a tmpfs = %v, want none", got)
+	}
+}
+
+func TestSetupProtectedOverlayRollbackKeepsProtection(t *testing.T) {
+	ctx := context.Background()
+	base := newTestBase(t)
+	env, mounter := newTestEnvironment(t, base, "dev")
+	_, _, merged := env.newOperation(ctx).getOverlayPaths(base, "other")
+
+	if err := env.Setup(ctx, SetupOptions{ProtectBase: true}); err != nil {
+		t.Fatalf("Setup: %v", err)
+	}
+
+	// The protection belongs to the overlay set up first
+	mounter.Fail[filepath.Join(merged, "sys")] = syscall.EPERM
+	other, err := env.WithOverlay("other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := other.Setup(ctx, SetupOptions{ProtectBase: true}); !errors.Is(err, syscall.EPERM) {
+		t.Fatalf("Setup error = %v, want EPERM", err)
+	}
+	if !env.newOperation(ctx).isReadOnlyBindMount(base) {
+		t.Errorf("failed Setup removed the protection of another overlay")
+	}
+}
+
+func TestSetupVersionImmutable(t *testing.T) {
+	ctx := context.Background()
+	base := newTestBase(t)
+	env, _ := newTestEnvironment(t, base, "dev")
+
+	if err := env.Setup(ctx, SetupOptions{}); err != nil {
+		t.Fatalf("Setup: %v", err)
+	}
+	if err := env.Cleanup(ctx); err != nil {
+		t.Fatalf("Cleanup: %v", err)
+	}
+	versionDir, err := env.Snapshot(ctx, "v1")
+	if err != nil {
+		t.Fatalf("Snapshot: %v", err)
+	}
+
+	version, mounter := newTestEnvironment(t, versionDir, "")
+	if err := version.Setup(ctx, SetupOptions{}); err == nil {
+		t.Errorf("writable Setup of a version succeeded")
+	}
+	if got := mountpoints(t, mounter); len(got) != 0 {
+		t.Errorf("mounts after refused Setup = %v, want none", got)
+	}
+
+	// Overlays on a version keep it read-only while they are mounted
+	overlay, err := version.WithOverlay("dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := overlay.Setup(ctx, SetupOptions{}); err != nil {
+		t.Fatalf("Setup of an overlay on a version: %v", err)
+	}
+	if !overlay.newOperation(ctx).isReadOnlyBindMount(versionDir) {
+		t.Errorf("version is writable while an overlay is mounted on it")
+	}
+	if err := overlay.Cleanup(ctx); err != nil {
+		t.Fatalf("Cleanup of the overlay: %v", err)
+	}
+	if got := mountpoints(t, mounter); len(got) != 0 {
+		t.Errorf("mounts after Cleanup = %v, want none", got)
+	}
+}
+
+func TestSetupOverlayEnsureKeepsEarlierSetup(t *testing.T) {
+	ctx := context.Background()
+	base := newTestBase(t)
+	env, mounter := newTestEnvironment(t, base, "dev")
+	op := env.newOperation(context.Background())
+	_, _, merged := op.getOverlayPaths(base, "dev")
+
+	if err := env.Setup(ctx, SetupOptions{}); err != nil {
+		t.Fatalf("Setup: %v", err)
+	}
+
+	// A failure while completing a setup leaves what was mounted before
+	sys := filepath.Join(merged, "sys")
+	if err := mounter.Unmount(sys, 0); err != nil {
+		t.Fatal(err)
+	}
+	mounter.Fail[sys] = syscall.EPERM
+
+	if err := env.Setup(ctx, SetupOptions{Ensure: true}); !errors.Is(err, syscall.EPERM) {
+		t.Fatalf("Setup with Ensure error = %v, want EPERM", err)
+	}
+	want := []string{merged, filepath.Join(merged, "proc"), filepath.Join(merged, "dev")}
+	if got := mountpoints(t, mounter); !slices.Equal(got, want) {
+		t.Errorf("mounts after failed Setup with Ensure = %v, want %v", got, want)
+	}
+}
+
+func TestPackImageInsideBase(t *testing.T) {
+	ctx := context.Background()
+	base := newTestBase(t)
+	env, _ := newTestEnvironment(t, base, "")
+
+	// Build the image with touch, so that the check does not depend on mksquashfs
+	build := packImageTools[ImageTypeSquashfs]
+	packImageTools[ImageTypeSquashfs] = func(src, image string) []string {
+		return []string{"touch", image}
+	}
+	t.Cleanup(func() { packImageTools[ImageTypeSquashfs] = build })
+
+	image := filepath.Join(base, "etc", "base.squashfs")
+	if err := env.Pack(ctx, image, PackOptions{}); err == nil {
+		t.Errorf("Pack into the base succeeded")
+	}
+	if pathExists(image) {
+		t.Errorf("image was created inside the base")
+	}
+}
+
+func TestSetupImageOverlay(t *testing.T) {
+	ctx := context.Background()
+	image, files := newTestImage(t)
+	env, mounter := newTestEnvironment(t, image, "dev")
+	mounter.Images[image] = files
+	op := env.newOperation(ctx)
+	root := op.getBaseRoot(image)
+	_, _, merged := op.getOverlayPaths(image, "dev")
+
+	if err := env.Setup(ctx, SetupOptions{}); err != nil {
+		t.Fatalf("Setup: %v", err)
+	}
+
+	want := append([]string{root, merged}, essentialMounts(merged)...)
+	if got := mountpoints(t, mounter); !slices.Equal(got, want) {
+		t.Errorf("mounts after Setup = %v, want %v", got, want)
+	}
+	if !op.isReadOnlyMount(root) {
+		t.Errorf("image base is mounted writable")
+	}
+	if !fileExists(filepath.Join(merged, "etc", "hostname")) {
+		t.Errorf("merged view does not show the image")
+	}
+
+	// The image is detached with its last overlay
+	if err := env.Cleanup(ctx); err != nil {
+		t.Fatalf("Cleanup: %v", err)
+	}
+	if got := mountpoints(t, mounter); len(got) != 0 {
+		t.Errorf("mounts after Cleanup = %v, want none", got)
+	}
+	if pathExists(root) {
+		t.Errorf("image mountpoint %s is left after Cleanup", root)
+	}
+}
+
+func TestSetupImageOverlayRollback(t *testing.T) {
+	ctx := context.Background()
+	image, files := newTestImage(t)
+	env, mounter := newTestEnvironment(t, image, "dev")
+	mounter.Images[image] = files
+	op := env.newOperation(ctx)
+	_, _, merged := op.getOverlayPaths(image, "dev")
+	mounter.Fail[filepath.Join(merged, "sys")] = syscall.EPERM
+
+	if err := env.Setup(ctx, SetupOptions{}); !errors.Is(err, syscall.EPERM) {
+		t.Fatalf("Setup error = %v, want EPERM", err)
+	}
+	if got := mountpoints(t, mounter); len(got) != 0 {
+		t.Errorf("mounts after failed Setup = %v, want none", got)
+	}
+}
+
+func TestSetupImageOverlayMountFailure(t *testing.T) {
+	ctx := context.Background()
+	image, files := newTestImage(t)
+	env, mounter := newTestEnvironment(t, image, "dev")
+	mounter.Images[image] = files
+	root := env.newOperation(ctx).getBaseRoot(image)
+	mounter.Fail[root] = syscall.ENXIO
+
+	if err := env.Setup(ctx, SetupOptions{}); !errors.Is(err, syscall.ENXIO) {
+		t.Fatalf("Setup error = %v, want ENXIO", err)
+	}
+	if got := mountpoints(t, mounter); len(got) != 0 {
+		t.Errorf("mounts after failed Setup = %v, want none", got)
+	}
+	if pathExists(root) {
+		t.Errorf("image mountpoint %s is left after failed Setup", root)
+	}
+}
+
+// skipWithoutMkfs skips tests formatting quota storage images where mkfs.ext4 is missing
+func skipWithoutMkfs(t *testing.T) {
+	t.Helper()
+	if _, err := exec.LookPath("mkfs.ext4"); err != nil {
+		t.Skip("mkfs.ext4 is needed to format storage images")
+	}
+}
+
+func TestSetupQuotaOverlay(t *testing.T) {
+	skipWithoutMkfs(t)
+
+	ctx := context.Background()
+	base := newTestBase(t)
+	env, mounter := newTestEnvironment(t, base, "dev")
+	op := env.newOperation(ctx)
+	overlayDir := op.getOverlayDir(base, "dev")
+	_, _, merged := op.getOverlayPaths(base, "dev")
+
+	if err := env.Setup(ctx, SetupOptions{Quota: "16M"}); err != nil {
+		t.Fatalf("Setup: %v", err)
+	}
+
+	want := append([]string{overlayDir, merged}, essentialMounts(merged)...)
+	if got := mountpoints(t, mounter); !slices.Equal(got, want) {
+		t.Errorf("mounts after Setup = %v, want %v", got, want)
+	}
+	if mount := op.findMount(overlayDir); mount == nil || mount.FSType != ImageTypeExt4 {
+		t.Errorf("storage image mount = %+v, want an ext4 loop mount", mount)
+	}
+
+	// The image is detached with the overlay, and attached again with it
+	if err := env.Cleanup(ctx); err != nil {
+		t.Fatalf("Cleanup: %v", err)
+	}
+	if got := mountpoints(t, mounter); len(got) != 0 {
+		t.Errorf("mounts after Cleanup = %v, want none", got)
+	}
+	if err := env.Setup(ctx, SetupOptions{}); err != nil {
+		t.Fatalf("second Setup: %v", err)
+	}
+	if got := mountpoints(t, mounter); !slices.Equal(got, want) {
+		t.Errorf("mounts after second Setup = %v, want %v", got, want)
+	}
+
+	if err := env.Remove(ctx, RemoveOptions{}); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	if got := mountpoints(t, mounter); len(got) != 0 {
+		t.Errorf("mounts after Remove = %v, want none", got)
+	}
+	if pathExists(overlayDir) || pathExists(op.getQuotaImagePath(base, "dev")) {
+		t.Errorf("overlay or storage image is left after Remove")
+	}
+}
+
+func TestSetupQuotaOverlayRollback(t *testing.T) {
+	skipWithoutMkfs(t)
+
+	ctx := context.Background()
+	base := newTestBase(t)
+	env, mounter := newTestEnvironment(t, base, "dev")
+	op := env.newOperation(ctx)
+	overlayDir, image := op.getOverlayDir(base, "dev"), op.getQuotaImagePath(base, "dev")
+	_, _, merged := op.getOverlayPaths(base, "dev")
+	sys := filepath.Join(merged, "sys")
+
+	// A new overlay is removed with its image
+	mounter.Fail[sys] = syscall.EPERM
+	if err := env.Setup(ctx, SetupOptions{Quota: "16M"}); !errors.Is(err, syscall.EPERM) {
+		t.Fatalf("Setup error = %v, want EPERM", err)
+	}
+	if got := mountpoints(t, mounter); len(got) != 0 {
+		t.Errorf("mounts after failed Setup = %v, want none", got)
+	}
+	if pathExists(overlayDir) || pathExists(image) {
+		t.Errorf("failed Setup of a new overlay left its directory or storage image")
+	}
+
+	// An existing overlay keeps its image, detached
+	delete(mounter.Fail, sys)
+	if err := env.Setup(ctx, SetupOptions{Quota: "16M"}); err != nil {
+		t.Fatalf("Setup: %v", err)
+	}
+	if err := env.Cleanup(ctx); err != nil {
+		t.Fatalf("Cleanup: %v", err)
+	}
+	mounter.Fail[sys] = syscall.EPERM
+	if err := env.Setup(ctx, SetupOptions{}); !errors.Is(err, syscall.EPERM) {
+		t.Fatalf("second Setup error = %v, want EPERM", err)
+	}
+	if got := mountpoints(t, mounter); len(got) != 0 {
+		t.Errorf("mounts after failed second Setup = %v, want none", got)
+	}
+	if !fileExists(image) {
+		t.Errorf("failed Setup of an existing overlay deleted its storage image")
+	}
+}
+
+func TestCleanupQuotaParent(t *testing.T) {
+	skipWithoutMkfs(t)
+
+	ctx := context.Background()
+	base := newTestBase(t)
+	parent, mounter := newTestEnvironment(t, base, "parent")
+	child, err := parent.WithOverlay("child")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parentDir := parent.newOperation(ctx).getOverlayDir(base, "parent")
+
+	if err := parent.Setup(ctx, SetupOptions{Quota: "16M"}); err != nil {
+		t.Fatalf("Setup of the parent: %v", err)
+	}
+	if err := parent.Cleanup(ctx); err != nil {
+		t.Fatalf("Cleanup of the parent: %v", err)
+	}
+	if err := child.Setup(ctx, SetupOptions{From: "parent"}); err != nil {
+		t.Fatalf("Setup of the child: %v", err)
+	}
+
+	// The parent's image serves as a lower layer until the child is cleaned up
+	if !mounter.IsMountPoint(parentDir) {
+		t.Errorf("storage image of the parent is not attached for its child")
+	}
+	if err := child.Cleanup(ctx); err != nil {
+		t.Fatalf("Cleanup of the child: %v", err)
+	}
+	if got := mountpoints(t, mounter); len(got) != 0 {
+		t.Errorf("mounts after Cleanup of the child = %v, want none", got)
+	}
+}
+
+func TestCleanupOverlay(t *testing.T) {
+	ctx := context.Background()
+	base := newTestBase(t)
+	env, mounter := newTestEnvironment(t, base, "dev")
+	op := env.newOperation(context.Background())
+	_, _, merged := op.getOverlayPaths(base, "dev")
+
+	if err := env.Setup(ctx, SetupOptions{}); err != nil {
+		t.Fatalf("Setup: %v", err)
+	}
+	if err := env.Cleanup(ctx); err != nil {
+		t.Fatalf("Cleanup: %v", err)
+	}
+
+	if got := mountpoints(t, mounter); len(got) != 0 {
+		t.Errorf("mounts after Cleanup = %v, want none", got)
+	}
+	if !dirExists(op.getOverlayDir(base, "dev")) {
+		t.Errorf("overlay directory was removed by Cleanup")
+	}
+	if entries, _ := os.ReadDir(merged); len(entries) != 0 {
+		t.Errorf("merged directory is not empty after Cleanup")
+	}
+
+	status, err := env.Status(ctx)
+	if err != nil {
+		t.Fatalf("Status: %v", err)
+	}
+	if status.Mounted {
+		t.Errorf("overlay is reported mounted after Cleanup")
+	}
+
+	missing, _ := env.WithOverlay("missing")
+	if err := missing.Cleanup(ctx); !errors.Is(err, ErrNotExist) {
+		t.Errorf("Cleanup of a missing overlay error = %v, want ErrNotExist", err)
+	}
+}
+
+func TestCleanupAll(t *testing.T) {
+	ctx := context.Background()
+	base := newTestBase(t)
+	env, mounter := newTestEnvironment(t, base, "a")
+
+	if err := env.Setup(ctx, SetupOptions{}); err != nil {
+		t.Fatalf("Setup a: %v", err)
+	}
+	other, _ := env.WithOverlay("b")
+	if err := other.Setup(ctx, SetupOptions{}); err != nil {
+		t.Fatalf("Setup b: %v", err)
+	}
+	if err := other.Cleanup(ctx); err != nil {
+		t.Fatalf("Cleanup b: %v", err)
+	}
+
+	baseEnv, err := New(base, "", Options{Logger: testLogger{t}, Mounter: mounter})
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, err := baseEnv.CleanupAll(ctx)
+	if err != nil {
+		t.Fatalf("CleanupAll: %v", err)
+	}
+
+	want := []CleanupResult{
+		{Name: "overlay 'a'", Result: "cleaned up"},
+		{Name: "overlay 'b'", Result: "not set up"},
+		{Name: "base", Result: "not set up"},
+	}
+	if !slices.Equal(results, want) {
+		t.Errorf("CleanupAll results = %v, want %v", results, want)
+	}
+	if got := mountpoints(t, mounter); len(got) != 0 {
+		t.Errorf("mounts after CleanupAll = %v, want none", got)
+	}
+}
+
+func TestCleanupAllQuotaStorage(t *testing.T) {
+	skipWithoutMkfs(t)
+
+	ctx := context.Background()
+	base := newTestBase(t)
+	env, mounter := newTestEnvironment(t, base, "a")
+
+	if err := env.Setup(ctx, SetupOptions{Quota: "16M"}); err != nil {
+		t.Fatalf("Setup: %v", err)
+	}
+	if err := env.Cleanup(ctx); err != nil {
+		t.Fatalf("Cleanup: %v", err)
+	}
+
+	// Reading the overlay attaches its storage image again
+	if _, err := env.Status(ctx); err != nil {
+		t.Fatalf("Status: %v", err)
+	}
+
+	baseEnv, err := New(base, "", Options{Logger: testLogger{t}, Mounter: mounter})
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, err := baseEnv.CleanupAll(ctx)
+	if err != nil {
+		t.Fatalf("CleanupAll: %v", err)
+	}
+
+	want := []CleanupResult{
+		{Name: "overlay 'a'", Result: "not set up"},
+		{Name: "overlay 'a' storage", Result: "image detached"},
+		{Name: "base", Result: "not set up"},
+	}
+	if !slices.Equal(results, want) {
+		t.Errorf("CleanupAll results = %v, want %v", results, want)
+	}
+	if got := mountpoints(t, mounter); len(got) != 0 {
+		t.Errorf("mounts after CleanupAll = %v, want none", got)
+	}
+}
+
+func TestCleanupAllImageBase(t *testing.T) {
+	ctx := context.Background()
+	image, files := newTestImage(t)
+	env, mounter := newTestEnvironment(t, image, "a")
+	mounter.Images[image] = files
+
+	if err := env.Setup(ctx, SetupOptions{}); err != nil {
+		t.Fatalf("Setup: %v", err)
+	}
+
+	baseEnv, err := New(image, "", Options{Logger: testLogger{t}, Mounter: mounter, ImageMountRoot: env.imageMountRoot})
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, err := baseEnv.CleanupAll(ctx)
+	if err != nil {
+		t.Fatalf("CleanupAll: %v", err)
+	}
+
+	want := []CleanupResult{
+		{Name: "overlay 'a'", Result: "cleaned up"},
+		{Name: "base", Result: "image unmounted"},
+	}
+	if !slices.Equal(results, want) {
+		t.Errorf("CleanupAll results = %v, want %v", results, want)
+	}
+	if got := mountpoints(t, mounter); len(got) != 0 {
+		t.Errorf("mounts after CleanupAll = %v, want none", got)
+	}
+}
+
+func TestResetTmpfsOverlayNotMounted(t *testing.T) {
+	ctx := context.Background()
+	base := newTestBase(t)
+	env, mounter := newTestEnvironment(t, base, "tmp")
+	op := env.newOperation(ctx)
+	upper, _, merged := op.getOverlayPaths(base, "tmp")
+
+	if err := env.Setup(ctx, SetupOptions{Tmpfs: true}); err != nil {
+		t.Fatalf("Setup: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(upper, "change"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the tmpfs is left, as after unmounting the overlay by hand
+	if err := mounter.Unmount(merged, syscall.MNT_DETACH); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := env.Reset(ctx, ResetOptions{Remount: true}); err != nil {
+		t.Fatalf("Reset: %v", err)
+	}
+	if fileExists(filepath.Join(upper, "change")) {
+		t.Errorf("change in the tmpfs survived Reset")
+	}
+	if !op.isTmpfsOverlay(base, "tmp") || !op.isOverlaySetup(base, "tmp") {
+		t.Errorf("overlay is not set up again on a tmpfs after Reset")
+	}
+}
+
+func TestResetRemountKeepsSetup(t *testing.T) {
+	for _, opts := range []SetupOptions{{ProtectBase: true}, {ReadOnly: true}} {
+		ctx := context.Background()
+		base := newTestBase(t)
+		env, _ := newTestEnvironment(t, base, "dev")
+		op := env.newOperation(ctx)
+		_, _, merged := op.getOverlayPaths(base, "dev")
+
+		// A read-only setup needs an existing overlay
+		if err := env.Setup(ctx, SetupOptions{}); err != nil {
+			t.Fatalf("Setup: %v", err)
+		}
+		if err := env.Cleanup(ctx); err != nil {
+			t.Fatalf("Cleanup: %v", err)
+		}
+		if err := env.Setup(ctx, opts); err != nil {
+			t.Fatalf("Setup: %v", err)
+		}
+
+		if err := env.Reset(ctx, ResetOptions{Remount: true}); err != nil {
+			t.Fatalf("Reset: %v", err)
+		}
+		if got := op.isReadOnlyBindMount(base); got != opts.ProtectBase {
+			t.Errorf("base protected after Reset = %v, want %v", got, opts.ProtectBase)
+		}
+		if got := op.isReadOnlyMount(merged); got != opts.ReadOnly {
+			t.Errorf("overlay read-only after Reset = %v, want %v", got, opts.ReadOnly)
+		}
+	}
+}
+
+func TestSetupBaseInUse(t *testing.T) {
+	ctx := context.Background()
+	base := newTestBase(t)
+	env, mounter := newTestEnvironment(t, base, "dev")
+
+	if err := env.Setup(ctx, SetupOptions{}); err != nil {
+		t.Fatalf("Setup: %v", err)
+	}
+
+	baseEnv, err := New(base, "", Options{Logger: testLogger{t}, Mounter: mounter})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := baseEnv.Setup(ctx, SetupOptions{}); !errors.Is(err, ErrInUse) {
+		t.Errorf("Setup of a base with mounted overlays error = %v, want ErrInUse", err)
+	}
+}
+
+func TestRemoveOverlay(t *testing.T) {
+	ctx := context.Background()
+	base := newTestBase(t)
+	env, mounter := newTestEnvironment(t, base, "dev")
+	op := env.newOperation(context.Background())
+	_, _, merged := op.getOverlayPaths(base, "dev")
+
+	if err := env.Setup(ctx, SetupOptions{}); err != nil {
+		t.Fatalf("Setup: %v", err)
+	}
+
+	// A busy merged view is detached lazily
+	mounter.Busy[merged] = true
+
+	if err := env.Remove(ctx, RemoveOptions{}); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	if got := mountpoints(t, mounter); len(got) != 0 {
+		t.Errorf("mounts after Remove = %v, want none", got)
+	}
+	if pathExists(op.getOverlayDir(base, "dev")) {
+		t.Errorf("overlay directory still exists after Remove")
+	}
+	if !fileExists(filepath.Join(base, "etc", "hostname")) {
+		t.Errorf("base was changed by Remove")
+	}
+}
+
+func TestRemoveStackedParent(t *testing.T) {
+	ctx := context.Background()
+	base := newTestBase(t)
+	parent, _ := newTestEnvironment(t, base, "parent")
+	op := parent.newOperation(context.Background())
+
+	if err := parent.Setup(ctx, SetupOptions{}); err != nil {
+		t.Fatalf("Setup parent: %v", err)
+	}
+	child, _ := parent.WithOverlay("child")
+	if err := child.Setup(ctx, SetupOptions{From: "parent"}); err != nil {
+		t.Fatalf("Setup child: %v", err)
+	}
+
+	if err := parent.Remove(ctx, RemoveOptions{}); !errors.Is(err, ErrInUse) {
+		t.Errorf("Remove of a parent overlay error = %v, want ErrInUse", err)
+	}
+	if !dirExists(op.getOverlayDir(base, "parent")) {
+		t.Errorf("parent overlay was removed")
+	}
+}
+
+func TestRemoveQuotaStackedParent(t *testing.T) {
+	skipWithoutMkfs(t)
+
+	ctx := context.Background()
+	base := newTestBase(t)
+	parent, mounter := newTestEnvironment(t, base, "parent")
+	op := parent.newOperation(context.Background())
+
+	if err := parent.Setup(ctx, SetupOptions{}); err != nil {
+		t.Fatalf("Setup parent: %v", err)
+	}
+	if err := parent.Cleanup(ctx); err != nil {
+		t.Fatalf("Cleanup parent: %v", err)
+	}
+	child, _ := parent.WithOverlay("child")
+	if err := child.Setup(ctx, SetupOptions{From: "parent", Quota: "16M"}); err != nil {
+		t.Fatalf("Setup child: %v", err)
+	}
+	if err := child.Cleanup(ctx); err != nil {
+		t.Fatalf("Cleanup child: %v", err)
+	}
+
+	// The child's metadata is only reachable through its detached image
+	if err := parent.Reset(ctx, ResetOptions{}); !errors.Is(err, ErrInUse) {
+		t.Errorf("Reset of a parent overlay error = %v, want ErrInUse", err)
+	}
+	if err := parent.Remove(ctx, RemoveOptions{}); !errors.Is(err, ErrInUse) {
+		t.Errorf("Remove of a parent overlay error = %v, want ErrInUse", err)
+	}
+	if !dirExists(op.getOverlayDir(base, "parent")) {
+		t.Errorf("parent overlay was removed")
+	}
+	if got := mountpoints(t, mounter); len(got) != 0 {
+		t.Errorf("mounts after the checks = %v, want none", got)
+	}
+}
+
+func TestBaseChanged(t *testing.T) {
+	ctx := context.Background()
+	base := newTestBase(t)
+	env, _ := newTestEnvironment(t, base, "dev")
+
+	if err := env.Setup(ctx, SetupOptions{}); err != nil {
+		t.Fatalf("Setup: %v", err)
+	}
+	if err := env.Cleanup(ctx); err != nil {
+		t.Fatalf("Cleanup: %v", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(base, "etc", "motd"), []byte("changed\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := env.Setup(ctx, SetupOptions{}); !errors.Is(err, ErrBaseChanged) {
+		t.Errorf("Setup on a changed base error = %v, want ErrBaseChanged", err)
+	}
+	if err := env.Setup(ctx, SetupOptions{AcceptDrift: true}); err != nil {
+		t.Errorf("Setup with AcceptDrift: %v", err)
+	}
+}
+
+func TestInvalidOverlayName(t *testing.T) {
+	for _, name := range []string{".", "..", "a/b"} {
+		if _, err := New(t.TempDir(), name, Options{}); !errors.Is(err, ErrInvalidName) {
+			t.Errorf("New with overlay %q error = %v, want ErrInvalidName", name, err)
+		}
+	}
+}
+
+func TestCanceledOperation(t *testing.T) {
+	base := newTestBase(t)
+	env, mounter := newTestEnvironment(t, base, "")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := env.Setup(ctx, SetupOptions{}); !errors.Is(err, context.Canceled) {
+		t.Errorf("Setup with a canceled context error = %v, want context.Canceled", err)
+	}
+	if got := mountpoints(t, mounter); len(got) != 0 {
+		t.Errorf("mounts after canceled Setup = %v, want none", got)
+	}
+}
+
+func TestResolveMergedPath(t *testing.T) {
+	base := newTestBase(t)
+	env, mounter := newTestEnvironment(t, base, "dev")
+	op := env.newOperation(context.Background())
+	_, _, merged := op.getOverlayPaths(base, "dev")
+
+	if err := env.Setup(context.Background(), SetupOptions{}); err != nil {
+		t.Fatalf("Setup: %v", err)
+	}
+
+	opts := Options{Mounter: mounter}
+	resolved, err := Resolve(filepath.Join(merged, "etc"), "", opts)
+	if err != nil {
+		t.Fatalf("Resolve: %v", err)
+	}
+	if resolved.Dir() != base || resolved.Overlay() != "dev" {
+		t.Errorf("Resolve = %s, overlay '%s', want %s, overlay 'dev'", resolved.Dir(), resolved.Overlay(), base)
+	}
+
+	if _, err := Resolve(merged, "other", opts); err == nil {
+		t.Errorf("Resolve of overlay 'dev' as overlay 'other' succeeded")
+	}
+}
@@ -0,0 +1,35 @@
+package chrootprep
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// ConfigPath is the location of the optional configuration file
+const ConfigPath = "/etc/chroot-prep.json"
+
+// Config holds settings read from the configuration file
+type Config struct {
+	// OverlayRoot stores overlays under <root>/<base name>/<overlay name>
+	// instead of next to the base directory
+	OverlayRoot string `json:"overlay_root"`
+}
+
+// LoadConfig reads the configuration file, returning an empty config if it does not exist
+func LoadConfig(path string) (*Config, error) {
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return &Config{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+
+	var config Config
+	if err := json.Unmarshal(content, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+
+	return &config, nil
+}
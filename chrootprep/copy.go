@@ -0,0 +1,114 @@
+package chrootprep
+
+import (
+	"fmt"
+	"os"
+)
+
+// copyBackend stores an environment as a full copy of the base, or of its
+// parent's copy, kept at the merged directory. Copies share their data with
+// the source through reflinks where the filesystem supports them, and are
+// plain copies otherwise. It is meant for hosts that cannot mount overlayfs.
+type copyBackend struct {
+	treeBackend
+}
+
+// createTreeCopy creates the copy of a new environment at its merged directory
+func (op *operation) createTreeCopy(chrootDir string, meta *OverlayMetadata) error {
+	source, err := op.treeSource(chrootDir, meta)
+	if err != nil {
+		return err
+	}
+
+	if !dirExists(source) {
+		return fmt.Errorf("%s does not exist", source)
+	}
+
+	// Contents of /proc, /dev and /sys must not end up in the copy
+	if err := op.validateNotMounted(source); err != nil {
+		return err
+	}
+
+	_, _, merged := op.getOverlayPaths(chrootDir, meta.Name)
+	if err := ensureDir(merged, 0755); err != nil {
+		return fmt.Errorf("failed to create merged directory: %w", err)
+	}
+
+	op.logf("Copying %s, this may take a while without reflink support...\n", source)
+	if err := op.copyTree(source, merged); err != nil {
+		os.RemoveAll(merged)
+		return err
+	}
+
+	return nil
+}
+
+// Validate checks that the merged directory exists
+func (b copyBackend) Validate(chrootDir string, overlayName string) error {
+	_, _, merged := b.getOverlayPaths(chrootDir, overlayName)
+	if !dirExists(merged) {
+		return fmt.Errorf("required overlay directory %s does not exist", merged)
+	}
+	return nil
+}
+
+// Prepare copies the base or the parent environment on first use
+func (b copyBackend) Prepare(chrootDir string, meta *OverlayMetadata, opts SetupOptions) error {
+	if err := validateTreeOptions(meta, opts); err != nil {
+		return err
+	}
+
+	_, _, merged := b.getOverlayPaths(chrootDir, meta.Name)
+	if dirExists(merged) {
+		return nil
+	}
+
+	return b.createTreeCopy(chrootDir, meta)
+}
+
+// Delete does nothing, the copy is deleted with the overlay directory
+func (copyBackend) Delete(chrootDir string, overlayName string) error {
+	return nil
+}
+
+// Clone copies the environment's tree
+func (b copyBackend) Clone(chrootDir string, overlayName string, newName string) error {
+	_, _, merged := b.getOverlayPaths(chrootDir, overlayName)
+	if err := b.validateNotMounted(merged); err != nil {
+		return err
+	}
+
+	_, _, newMerged := b.getOverlayPaths(chrootDir, newName)
+	if err := ensureDir(newMerged, 0755); err != nil {
+		return fmt.Errorf("failed to create merged directory: %w", err)
+	}
+	return b.copyTree(merged, newMerged)
+}
+
+// Reset replaces the tree with a fresh copy of its source
+func (b copyBackend) Reset(chrootDir string, meta *OverlayMetadata) error {
+	_, _, merged := b.getOverlayPaths(chrootDir, meta.Name)
+	if err := os.RemoveAll(merged); err != nil {
+		return fmt.Errorf("failed to remove %s: %w", merged, err)
+	}
+	return b.createTreeCopy(chrootDir, meta)
+}
+
+// Materialize copies the environment's tree
+func (b copyBackend) Materialize(chrootDir string, meta *OverlayMetadata, dest string) error {
+	_, _, merged := b.getOverlayPaths(chrootDir, meta.Name)
+	if err := b.validateNotMounted(merged); err != nil {
+		return err
+	}
+
+	if err := ensureDir(dest, 0755); err != nil {
+		return err
+	}
+
+	if err := b.copyTree(merged, dest); err != nil {
+		removeIfExists(dest)
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,292 @@
+package chrootprep
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"sort"
+	"syscall"
+)
+
+// opaqueXattrs mark an upper directory whose lower contents are hidden
+var opaqueXattrs = []string{"trusted.overlay.opaque", "user.overlay.opaque"}
+
+// redirectXattrs mark an upper directory whose lower contents are found
+// under another path, or an upper file whose data is in a lower layer
+var redirectXattrs = []string{
+	"trusted.overlay.redirect", "user.overlay.redirect",
+	"trusted.overlay.metacopy", "user.overlay.metacopy",
+}
+
+// essentialMountpoints are the directories setup mounts host filesystems on
+var essentialMountpoints = map[string]bool{
+	"dev":  true,
+	"proc": true,
+	"sys":  true,
+}
+
+// getOverlayLayers returns the layers of an overlay's merged view, topmost first
+func (op *operation) getOverlayLayers(chrootDir string, overlayName string) ([]string, error) {
+	meta, err := op.loadOverlayMetadata(chrootDir, overlayName)
+	if err != nil {
+		return nil, err
+	}
+
+	return op.getOverlayBackend(chrootDir, overlayName).Layers(chrootDir, meta), nil
+}
+
+// visibleLayers returns the layers providing a path in a merged view, given
+// the layers providing its parent directory. A non-directory is provided by
+// a single layer; a directory merges layers down to the first opaque one.
+// Redirected directories and metacopy files are refused, as their contents
+// are not found at the same path in the lower layers.
+func visibleLayers(parentLayers []string, rel string) ([]string, error) {
+	var layers []string
+	for _, layer := range parentLayers {
+		path := filepath.Join(layer, rel)
+
+		var st syscall.Stat_t
+		if err := syscall.Lstat(path, &st); err != nil {
+			continue
+		}
+
+		if isWhiteout(&st) {
+			break
+		}
+
+		if err := checkNotRedirected(path, &st); err != nil {
+			return nil, err
+		}
+
+		if st.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+			if len(layers) == 0 {
+				layers = append(layers, layer)
+			}
+			break
+		}
+
+		layers = append(layers, layer)
+		if isOpaqueDir(path) {
+			break
+		}
+	}
+	return layers, nil
+}
+
+// isWhiteout checks if an entry is an overlayfs whiteout (a 0/0 character device)
+func isWhiteout(st *syscall.Stat_t) bool {
+	return st.Mode&syscall.S_IFMT == syscall.S_IFCHR && st.Rdev == 0
+}
+
+// checkNotRedirected fails for a directory or regular file carrying a
+// redirect or metacopy attribute, written with redirect_dir=on or metacopy=on.
+// Symlinks are skipped, getxattr would follow them.
+func checkNotRedirected(path string, st *syscall.Stat_t) error {
+	if format := st.Mode & syscall.S_IFMT; format != syscall.S_IFDIR && format != syscall.S_IFREG {
+		return nil
+	}
+
+	for _, xattr := range redirectXattrs {
+		if _, err := syscall.Getxattr(path, xattr, nil); err == nil {
+			return fmt.Errorf("%s has the %s attribute, overlays with redirected directories or metacopy files cannot be compared", path, xattr)
+		}
+	}
+	return nil
+}
+
+// isOpaqueDir checks if an upper directory hides the contents of lower layers
+func isOpaqueDir(path string) bool {
+	buf := make([]byte, 1)
+	for _, xattr := range opaqueXattrs {
+		if n, err := syscall.Getxattr(path, xattr, buf); err == nil && n == 1 && buf[0] == 'y' {
+			return true
+		}
+	}
+	return false
+}
+
+// listLayerNames returns the sorted names found in a directory across its layers
+func listLayerNames(layers []string, rel string) ([]string, error) {
+	seen := make(map[string]bool)
+	for _, layer := range layers {
+		entries, err := os.ReadDir(filepath.Join(layer, rel))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", filepath.Join(layer, rel), err)
+		}
+		for _, entry := range entries {
+			seen[entry.Name()] = true
+		}
+	}
+
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// isDirLayers checks if the entry provided by a set of layers is a directory
+func isDirLayers(layers []string, rel string) bool {
+	return isDirectory(filepath.Join(layers[0], rel))
+}
+
+// diffOverlays reports the paths that differ between the merged views of two
+// overlays of the same base, without mounting them. Added paths exist only
+// in the overlay, removed paths only in the overlay it is compared against.
+func (op *operation) diffOverlays(chrootDir string, overlayName string, againstName string, content bool) (*DiffStats, error) {
+	if overlayName == againstName {
+		return nil, fmt.Errorf("cannot compare overlay '%s' with itself", overlayName)
+	}
+
+	for _, name := range []string{overlayName, againstName} {
+		if err := op.validateOverlayStructure(chrootDir, name); err != nil {
+			return nil, err
+		}
+	}
+
+	layers, err := op.getOverlayLayers(chrootDir, overlayName)
+	if err != nil {
+		return nil, err
+	}
+
+	againstLayers, err := op.getOverlayLayers(chrootDir, againstName)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &DiffStats{}
+	if err := op.diffDir(layers, againstLayers, ".", content, stats); err != nil {
+		return nil, err
+	}
+
+	return stats, nil
+}
+
+// diffDir compares the contents of a directory present in both merged views
+func (op *operation) diffDir(layers, againstLayers []string, rel string, content bool, stats *DiffStats) error {
+	// Directories provided by the same layers are identical, which skips
+	// everything that only falls through to the base or a shared parent
+	if slices.Equal(layers, againstLayers) {
+		return nil
+	}
+
+	names, err := listLayerNames(append(slices.Clone(layers), againstLayers...), rel)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		if err := op.canceled(); err != nil {
+			return err
+		}
+
+		child := filepath.Join(rel, name)
+		childLayers, err := visibleLayers(layers, child)
+		if err != nil {
+			return err
+		}
+		againstChildLayers, err := visibleLayers(againstLayers, child)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case len(childLayers) == 0 && len(againstChildLayers) == 0:
+			// Whited out in both
+
+		case len(againstChildLayers) == 0:
+			stats.Added++
+			op.printDiffEntry("A", childLayers, child)
+
+		case len(childLayers) == 0:
+			stats.Removed++
+			op.printDiffEntry("D", againstChildLayers, child)
+
+		default:
+			if err := op.diffEntry(childLayers, againstChildLayers, child, content, stats); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// diffEntry compares a path present in both merged views
+func (op *operation) diffEntry(layers, againstLayers []string, rel string, content bool, stats *DiffStats) error {
+	path := filepath.Join(layers[0], rel)
+	againstPath := filepath.Join(againstLayers[0], rel)
+
+	var st, againstSt syscall.Stat_t
+	if err := syscall.Lstat(path, &st); err != nil {
+		return fmt.Errorf("failed to stat %s: %w", path, err)
+	}
+	if err := syscall.Lstat(againstPath, &againstSt); err != nil {
+		return fmt.Errorf("failed to stat %s: %w", againstPath, err)
+	}
+
+	isDir := st.Mode&syscall.S_IFMT == syscall.S_IFDIR
+	againstIsDir := againstSt.Mode&syscall.S_IFMT == syscall.S_IFDIR
+
+	if isDir && againstIsDir {
+		if st.Mode != againstSt.Mode || st.Uid != againstSt.Uid || st.Gid != againstSt.Gid {
+			stats.Changed++
+			op.printDiffEntry("M", layers, rel)
+		}
+		// Mountpoints of essential filesystems show host contents in mounted snapshots
+		if essentialMountpoints[rel] {
+			return nil
+		}
+		return op.diffDir(layers, againstLayers, rel, content, stats)
+	}
+
+	if path == againstPath {
+		return nil
+	}
+
+	changed, err := isChangedEntry(path, againstPath, &st, &againstSt)
+	if err != nil {
+		return fmt.Errorf("failed to compare %s: %w", rel, err)
+	}
+	if !changed {
+		return nil
+	}
+
+	stats.Changed++
+	op.printDiffEntry("M", layers, rel)
+
+	isRegular := st.Mode&syscall.S_IFMT == syscall.S_IFREG
+	againstIsRegular := againstSt.Mode&syscall.S_IFMT == syscall.S_IFREG
+	if content && isRegular && againstIsRegular {
+		return op.diffContent(againstPath, path, rel)
+	}
+
+	return nil
+}
+
+// printDiffEntry reports a differing path, marking directories with a trailing slash
+func (op *operation) printDiffEntry(status string, layers []string, rel string) {
+	path := "/" + rel
+	if isDirLayers(layers, rel) {
+		path += "/"
+	}
+	fmt.Fprintf(op.output, "%s %s\n", status, path)
+}
+
+// diffContent reports a unified diff between two versions of a file
+func (op *operation) diffContent(againstPath, path, rel string) error {
+	cmd := op.command("diff", "-u", "--label", "a/"+rel, "--label", "b/"+rel, againstPath, path)
+	cmd.Stdout = op.output
+
+	// diff exits with 1 when the files differ
+	var exitErr *exec.ExitError
+	if err := op.runCommand(cmd); err != nil && !(errors.As(err, &exitErr) && exitErr.ExitCode() == 1) {
+		return fmt.Errorf("failed to diff %s: %w", rel, err)
+	}
+
+	return nil
+}
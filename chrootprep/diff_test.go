@@ -0,0 +1,78 @@
+package chrootprep
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// newTestOverlays creates unmounted overlays of base, the first one in env
+func newTestOverlays(t *testing.T, env *Environment, names ...string) {
+	t.Helper()
+
+	ctx := context.Background()
+	for _, name := range names {
+		overlay, err := env.WithOverlay(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := overlay.Setup(ctx, SetupOptions{}); err != nil {
+			t.Fatalf("Setup %s: %v", name, err)
+		}
+		if err := overlay.Cleanup(ctx); err != nil {
+			t.Fatalf("Cleanup %s: %v", name, err)
+		}
+	}
+}
+
+func TestDiffOverlays(t *testing.T) {
+	ctx := context.Background()
+	base := newTestBase(t)
+	env, _ := newTestEnvironment(t, base, "a")
+	newTestOverlays(t, env, "a", "b")
+	upper, _, _ := env.newOperation(ctx).getOverlayPaths(base, "a")
+
+	for _, dir := range []string{"opt/a", "etc"} {
+		if err := os.MkdirAll(filepath.Join(upper, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(upper, "etc", "hostname"), []byte("a\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := env.Diff(ctx, "b", DiffOptions{})
+	if err != nil {
+		t.Fatalf("Diff: %v", err)
+	}
+	if *stats != (DiffStats{Added: 1, Changed: 1}) {
+		t.Errorf("Diff = %+v, want 1 added and 1 changed", *stats)
+	}
+}
+
+func TestDiffRedirectedOverlay(t *testing.T) {
+	ctx := context.Background()
+	base := newTestBase(t)
+	env, _ := newTestEnvironment(t, base, "a")
+	newTestOverlays(t, env, "a", "b")
+	upper, _, _ := env.newOperation(ctx).getOverlayPaths(base, "a")
+
+	// As left by renaming /etc to /opt with redirect_dir=on
+	opt := filepath.Join(upper, "opt")
+	if err := os.Mkdir(opt, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Setxattr(opt, "user.overlay.redirect", []byte("/etc"), 0); err != nil {
+		if errors.Is(err, syscall.ENOTSUP) {
+			t.Skip("user extended attributes are not supported here")
+		}
+		t.Fatal(err)
+	}
+
+	if _, err := env.Diff(ctx, "b", DiffOptions{}); err == nil {
+		t.Errorf("Diff of an overlay with a redirected directory succeeded")
+	}
+}
@@ -0,0 +1,364 @@
+package chrootprep
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Issue is an inconsistency found by Doctor, with its repair
+type Issue struct {
+	Kind    string
+	Problem string
+	Repair  string
+	// Err is the error of the repair, when it was run and failed
+	Err error
+	// Skipped is set for issues that are only reported, such as orphaned
+	// overlays without DeleteOrphans. Fixing leaves them as they are.
+	Skipped bool
+	fix     func() error
+}
+
+// findDoctorIssues scans the mount table and the overlays found there,
+// under the overlay root and next to an optional base, for stale or
+// orphaned state. Issues are returned in the order they must be fixed.
+// Orphaned overlays are only deleted when deleteOrphans is set.
+func (op *operation) findDoctorIssues(chrootDir string, deleteOrphans bool) ([]Issue, error) {
+	mounts, err := op.readMountInfo()
+	if err != nil {
+		return nil, err
+	}
+
+	var stale, deleted, orphaned, leftover []Issue
+	for _, overlayDir := range op.findDoctorOverlays(chrootDir, mounts) {
+		merged := filepath.Join(overlayDir, MergedDir)
+		mounted := hasMountsBelow(mounts, merged)
+
+		// A detached size-limited overlay keeps its metadata and layers in its image
+		var meta *OverlayMetadata
+		var metaErr error
+		leftoverWork := false
+		err := op.withOverlayStorage(overlayDir, func() error {
+			meta, metaErr = readOverlayMetadataFile(filepath.Join(overlayDir, MetadataFile))
+			entries, err := os.ReadDir(filepath.Join(overlayDir, WorkDir, "work"))
+			leftoverWork = err == nil && len(entries) > 0
+			return nil
+		})
+		if err != nil {
+			op.logf("Warning: cannot check overlay at %s: %v\n", overlayDir, err)
+			continue
+		}
+
+		// Setup records the metadata before mounting anything, so a mounted
+		// overlay without it was left behind
+		if metaErr != nil || meta == nil {
+			if mounted && !isPathInUse(merged) {
+				stale = append(stale, op.staleMountIssue(overlayDir, nil))
+			}
+			continue
+		}
+
+		// A complete setup is left alone, even when nothing uses it
+		if mounted && !isSetupComplete(mounts, merged, meta) && !isPathInUse(merged) {
+			stale = append(stale, op.staleMountIssue(overlayDir, meta))
+		}
+
+		// Overlays of the other backends hold a full tree and outlive their base
+		if backendName(meta) != BackendOverlay {
+			continue
+		}
+
+		if !pathExists(meta.Base) {
+			orphaned = append(orphaned, op.orphanedOverlayIssue(overlayDir, meta, deleteOrphans))
+			continue
+		}
+
+		if !mounted && leftoverWork {
+			leftover = append(leftover, op.leftoverWorkIssue(overlayDir, meta))
+		}
+	}
+
+	for _, base := range findDeletedBases(mounts) {
+		deleted = append(deleted, op.deletedBaseIssue(base, mounts))
+	}
+
+	return slices.Concat(stale, deleted, orphaned, leftover), nil
+}
+
+// findDoctorOverlays returns the overlay directories mounted in the mount
+// table, stored under the overlay root, or belonging to a base. Those only
+// found in the mount table must have metadata, as other tools mount at
+// directories named merged as well.
+func (op *operation) findDoctorOverlays(chrootDir string, mounts []MountInfo) []string {
+	seen := make(map[string]bool)
+
+	// <overlay>/merged, or an essential filesystem in it
+	for _, mount := range mounts {
+		mountpoint := mount.MountPoint
+		if essentialMountpoints[filepath.Base(mountpoint)] {
+			mountpoint = filepath.Dir(mountpoint)
+		}
+		if filepath.Base(mountpoint) == MergedDir && fileExists(filepath.Join(filepath.Dir(mountpoint), MetadataFile)) {
+			seen[filepath.Dir(mountpoint)] = true
+		}
+	}
+
+	// <root>/<base name>/<name>
+	if op.overlayRoot != "" {
+		baseDirs, _ := os.ReadDir(op.overlayRoot)
+		for _, baseDir := range baseDirs {
+			overlayDirs, _ := os.ReadDir(filepath.Join(op.overlayRoot, baseDir.Name()))
+			for _, overlayDir := range overlayDirs {
+				if overlayDir.IsDir() {
+					seen[filepath.Join(op.overlayRoot, baseDir.Name(), overlayDir.Name())] = true
+				}
+			}
+		}
+	}
+
+	if chrootDir != "" {
+		for _, name := range op.findOverlays(chrootDir) {
+			seen[op.getOverlayDir(chrootDir, name)] = true
+		}
+	}
+
+	overlayDirs := make([]string, 0, len(seen))
+	for overlayDir := range seen {
+		overlayDirs = append(overlayDirs, overlayDir)
+	}
+	sort.Strings(overlayDirs)
+	return overlayDirs
+}
+
+// hasMountsBelow checks if anything is mounted at or below a path
+func hasMountsBelow(mounts []MountInfo, path string) bool {
+	for _, mount := range mounts {
+		if isWithin(mount.MountPoint, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// isSetupComplete checks if a mounted overlay has everything a setup
+// mounts: the overlay filesystem at merged, for the overlay backend, and
+// the essential filesystems in it
+func isSetupComplete(mounts []MountInfo, merged string, meta *OverlayMetadata) bool {
+	mountpoints := make(map[string]bool)
+	for _, mount := range mounts {
+		mountpoints[mount.MountPoint] = true
+	}
+
+	if backendName(meta) == BackendOverlay && !mountpoints[merged] {
+		return false
+	}
+	for name := range essentialMountpoints {
+		if !mountpoints[filepath.Join(merged, name)] {
+			return false
+		}
+	}
+	return true
+}
+
+// isPathInUse checks if a process other than this one has its root, its
+// working directory, its executable or an open file at or below a path
+func isPathInUse(path string) bool {
+	procs, err := os.ReadDir("/proc")
+	if err != nil {
+		// Without a process list, assume the worst
+		return true
+	}
+
+	self := strconv.Itoa(os.Getpid())
+	for _, proc := range procs {
+		if _, err := strconv.Atoi(proc.Name()); err != nil || proc.Name() == self {
+			continue
+		}
+
+		procDir := filepath.Join("/proc", proc.Name())
+		links := []string{"root", "cwd", "exe"}
+		fds, _ := os.ReadDir(filepath.Join(procDir, "fd"))
+		for _, fd := range fds {
+			links = append(links, filepath.Join("fd", fd.Name()))
+		}
+
+		for _, link := range links {
+			target, err := os.Readlink(filepath.Join(procDir, link))
+			if err == nil && isWithin(target, path) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// findDeletedBases returns the directories holding essential filesystems
+// mounted by a setup whose base has since been deleted. A base counts as
+// deleted when it is gone, or when nothing but its mountpoints is left.
+func findDeletedBases(mounts []MountInfo) []string {
+	seen := make(map[string]bool)
+	for _, mount := range mounts {
+		base := filepath.Dir(mount.MountPoint)
+		if !essentialMountpoints[filepath.Base(mount.MountPoint)] || base == "/" || seen[base] {
+			continue
+		}
+
+		// Overlays are checked through their metadata
+		if filepath.Base(base) == MergedDir && fileExists(filepath.Join(filepath.Dir(base), MetadataFile)) {
+			continue
+		}
+
+		if !dirExists(base) || hasOnlyMountpoints(base) {
+			seen[base] = true
+		}
+	}
+
+	bases := make([]string, 0, len(seen))
+	for base := range seen {
+		bases = append(bases, base)
+	}
+	sort.Strings(bases)
+	return bases
+}
+
+// hasOnlyMountpoints checks if a directory holds nothing but the essential mountpoints
+func hasOnlyMountpoints(dir string) bool {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return false
+	}
+
+	for _, entry := range entries {
+		if !essentialMountpoints[entry.Name()] {
+			return false
+		}
+	}
+	return true
+}
+
+// staleMountIssue reports an overlay left mounted by a setup that never
+// completed, or without metadata when meta is nil, that nothing uses
+func (op *operation) staleMountIssue(overlayDir string, meta *OverlayMetadata) Issue {
+	merged := filepath.Join(overlayDir, MergedDir)
+	problem := fmt.Sprintf("overlay at %s is mounted at %s but has no metadata, and no process uses it", overlayDir, merged)
+	if meta != nil {
+		problem = fmt.Sprintf("overlay '%s' of %s is partly mounted at %s by a setup that never completed, and no process uses it", meta.Name, meta.Base, merged)
+	}
+
+	return Issue{
+		Kind:    "stale mount",
+		Problem: problem,
+		Repair:  "unmount it",
+		fix: func() error {
+			// Unmounting fails on what becomes busy in the meantime
+			if isPathInUse(merged) {
+				return fmt.Errorf("%s is now %w", merged, ErrInUse)
+			}
+
+			op.umountEssentialFS(merged)
+			if op.findMount(merged) != nil {
+				if err := op.umountPath(merged); err != nil {
+					return err
+				}
+			}
+
+			// The base of an overlay without metadata is not known
+			if meta != nil && dirExists(meta.Base) {
+				return op.releaseBaseProtection(meta.Base)
+			}
+			return nil
+		},
+	}
+}
+
+// deletedBaseIssue reports essential filesystems left mounted in a deleted base
+func (op *operation) deletedBaseIssue(base string, mounts []MountInfo) Issue {
+	var mountpoints, names []string
+	for _, mount := range mounts {
+		if filepath.Dir(mount.MountPoint) == base && essentialMountpoints[filepath.Base(mount.MountPoint)] {
+			mountpoints = append(mountpoints, mount.MountPoint)
+			names = append(names, filepath.Base(mount.MountPoint))
+		}
+	}
+
+	return Issue{
+		Kind:    "deleted base",
+		Problem: fmt.Sprintf("%s still mounted in deleted base %s", strings.Join(names, ", "), base),
+		Repair:  "unmount them",
+		fix: func() error {
+			// Later mounts are stacked on top of earlier ones
+			for i := len(mountpoints) - 1; i >= 0; i-- {
+				if err := op.umountPath(mountpoints[i]); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	}
+}
+
+// orphanedOverlayIssue reports an overlay whose base no longer exists. Its
+// layers may be all that is left of the work done in it, so it is only
+// deleted when asked for explicitly.
+func (op *operation) orphanedOverlayIssue(overlayDir string, meta *OverlayMetadata, deleteOrphans bool) Issue {
+	problem := fmt.Sprintf("overlay '%s' at %s belongs to base %s, which no longer exists", meta.Name, overlayDir, meta.Base)
+	if !deleteOrphans {
+		return Issue{
+			Kind:    "orphaned overlay",
+			Problem: problem,
+			Repair:  "keep its layers, or delete the overlay with -delete-orphans",
+			Skipped: true,
+		}
+	}
+
+	return Issue{
+		Kind:    "orphaned overlay",
+		Problem: problem,
+		Repair:  "delete the overlay",
+		fix: func() error {
+			if op.findMount(filepath.Join(overlayDir, MergedDir)) != nil {
+				return fmt.Errorf("overlay '%s' is %w", meta.Name, ErrMounted)
+			}
+
+			if err := op.detachOverlayStorage(overlayDir); err != nil {
+				return err
+			}
+
+			// The layers of a tmpfs-backed overlay go away with the tmpfs
+			ephemeral := false
+			if mount := op.findMount(overlayDir); mount != nil && mount.FSType == MountTypeTmpfs {
+				if err := op.umountPath(overlayDir); err != nil {
+					return err
+				}
+				ephemeral = true
+			}
+
+			return op.deleteOverlayDir(overlayDir, ephemeral)
+		},
+	}
+}
+
+// leftoverWorkIssue reports files left in the work directory of an
+// unmounted overlay by an interrupted copy-up. Only work/work is emptied,
+// work/index holds the inode index of overlays mounted with index=on.
+func (op *operation) leftoverWorkIssue(overlayDir string, meta *OverlayMetadata) Issue {
+	work := filepath.Join(overlayDir, WorkDir, "work")
+	return Issue{
+		Kind:    "leftover work",
+		Problem: fmt.Sprintf("overlay '%s' of %s has leftover files in %s", meta.Name, meta.Base, work),
+		Repair:  "empty the work directory",
+		fix: func() error {
+			if op.findMount(filepath.Join(overlayDir, MergedDir)) != nil {
+				return fmt.Errorf("overlay '%s' is now mounted", meta.Name)
+			}
+			return op.withOverlayStorage(overlayDir, func() error {
+				return emptyDir(work)
+			})
+		},
+	}
+}
@@ -0,0 +1,168 @@
+package chrootprep
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// doctor runs Doctor on base with the mounter of a test environment
+func doctor(t *testing.T, base string, mounter *FakeMounter, doctorOpts DoctorOptions) ([]Issue, error) {
+	t.Helper()
+	return Doctor(context.Background(), base, doctorOpts, Options{Logger: testLogger{t}, Mounter: mounter})
+}
+
+func TestDoctorOrphanedOverlay(t *testing.T) {
+	ctx := context.Background()
+	base := newTestBase(t)
+	env, mounter := newTestEnvironment(t, base, "dev")
+	overlayDir := env.newOperation(ctx).getOverlayDir(base, "dev")
+
+	if err := env.Setup(ctx, SetupOptions{}); err != nil {
+		t.Fatalf("Setup: %v", err)
+	}
+	if err := env.Cleanup(ctx); err != nil {
+		t.Fatalf("Cleanup: %v", err)
+	}
+	if err := os.RemoveAll(base); err != nil {
+		t.Fatal(err)
+	}
+
+	// The overlay is only reported, even with Fix
+	issues, err := doctor(t, base, mounter, DoctorOptions{Fix: true})
+	if err != nil || len(issues) != 1 || issues[0].Kind != "orphaned overlay" || !issues[0].Skipped {
+		t.Fatalf("Doctor = %+v, %v, want a skipped orphaned overlay", issues, err)
+	}
+	if !dirExists(overlayDir) {
+		t.Fatalf("Doctor deleted the orphaned overlay without DeleteOrphans")
+	}
+
+	issues, err = doctor(t, base, mounter, DoctorOptions{Fix: true, DeleteOrphans: true})
+	if err != nil || len(issues) != 1 {
+		t.Fatalf("Doctor with DeleteOrphans = %+v, %v, want one repaired issue", issues, err)
+	}
+	if pathExists(overlayDir) {
+		t.Errorf("orphaned overlay is left after Doctor with DeleteOrphans")
+	}
+}
+
+func TestDoctorStaleMount(t *testing.T) {
+	ctx := context.Background()
+	base := newTestBase(t)
+	env, mounter := newTestEnvironment(t, base, "dev")
+	op := env.newOperation(ctx)
+	_, _, merged := op.getOverlayPaths(base, "dev")
+
+	if err := env.Setup(ctx, SetupOptions{}); err != nil {
+		t.Fatalf("Setup: %v", err)
+	}
+
+	// A complete setup is not stale, even when idle
+	if issues, err := doctor(t, base, mounter, DoctorOptions{}); err != nil || len(issues) != 0 {
+		t.Fatalf("Doctor on a complete setup = %+v, %v, want no issues", issues, err)
+	}
+
+	// As left by a setup interrupted before mounting sys
+	if err := mounter.Unmount(filepath.Join(merged, "sys"), 0); err != nil {
+		t.Fatal(err)
+	}
+	issues, err := doctor(t, base, mounter, DoctorOptions{Fix: true})
+	if err != nil || len(issues) != 1 || issues[0].Kind != "stale mount" {
+		t.Fatalf("Doctor on a partial setup = %+v, %v, want a repaired stale mount", issues, err)
+	}
+	if got := mountpoints(t, mounter); len(got) != 0 {
+		t.Errorf("mounts after Doctor = %v, want none", got)
+	}
+}
+
+func TestDoctorMountWithoutMetadata(t *testing.T) {
+	ctx := context.Background()
+	base := newTestBase(t)
+	env, mounter := newTestEnvironment(t, base, "dev")
+	overlayDir := env.newOperation(ctx).getOverlayDir(base, "dev")
+
+	if err := env.Setup(ctx, SetupOptions{}); err != nil {
+		t.Fatalf("Setup: %v", err)
+	}
+	if err := os.Remove(filepath.Join(overlayDir, MetadataFile)); err != nil {
+		t.Fatal(err)
+	}
+
+	issues, err := doctor(t, base, mounter, DoctorOptions{Fix: true})
+	if err != nil || len(issues) != 1 || issues[0].Kind != "stale mount" {
+		t.Fatalf("Doctor = %+v, %v, want a repaired stale mount", issues, err)
+	}
+	if got := mountpoints(t, mounter); len(got) != 0 {
+		t.Errorf("mounts after Doctor = %v, want none", got)
+	}
+}
+
+func TestDoctorLeftoverWork(t *testing.T) {
+	ctx := context.Background()
+	base := newTestBase(t)
+	env, mounter := newTestEnvironment(t, base, "dev")
+	_, work, _ := env.newOperation(ctx).getOverlayPaths(base, "dev")
+
+	if err := env.Setup(ctx, SetupOptions{}); err != nil {
+		t.Fatalf("Setup: %v", err)
+	}
+	if err := env.Cleanup(ctx); err != nil {
+		t.Fatalf("Cleanup: %v", err)
+	}
+
+	// As left by an interrupted copy-up, next to the index of index=on
+	for _, dir := range []string{"work/#1", "index/00fb"} {
+		if err := os.MkdirAll(filepath.Join(work, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	issues, err := doctor(t, base, mounter, DoctorOptions{Fix: true})
+	if err != nil || len(issues) != 1 || issues[0].Kind != "leftover work" {
+		t.Fatalf("Doctor = %+v, %v, want a repaired leftover work", issues, err)
+	}
+	if pathExists(filepath.Join(work, "work", "#1")) {
+		t.Errorf("leftover work is still there after Doctor")
+	}
+	if !dirExists(filepath.Join(work, "index", "00fb")) {
+		t.Errorf("Doctor emptied the index of the overlay")
+	}
+}
+
+func TestDoctorOrphanedQuotaOverlay(t *testing.T) {
+	skipWithoutMkfs(t)
+
+	ctx := context.Background()
+	base := newTestBase(t)
+	env, mounter := newTestEnvironment(t, base, "dev")
+	op := env.newOperation(ctx)
+	overlayDir := op.getOverlayDir(base, "dev")
+
+	if err := env.Setup(ctx, SetupOptions{Quota: "16M"}); err != nil {
+		t.Fatalf("Setup: %v", err)
+	}
+	if err := env.Cleanup(ctx); err != nil {
+		t.Fatalf("Cleanup: %v", err)
+	}
+	if err := os.RemoveAll(base); err != nil {
+		t.Fatal(err)
+	}
+
+	// The metadata is only reachable through the detached image
+	issues, err := doctor(t, base, mounter, DoctorOptions{})
+	if err != nil || len(issues) != 1 || issues[0].Kind != "orphaned overlay" {
+		t.Fatalf("Doctor = %+v, %v, want an orphaned overlay", issues, err)
+	}
+	if got := mountpoints(t, mounter); len(got) != 0 {
+		t.Errorf("mounts after Doctor = %v, want none", got)
+	}
+
+	issues, err = doctor(t, base, mounter, DoctorOptions{Fix: true, DeleteOrphans: true})
+	if err != nil || len(issues) != 1 {
+		t.Fatalf("Doctor with DeleteOrphans = %+v, %v, want one repaired issue", issues, err)
+	}
+	if pathExists(overlayDir) || pathExists(overlayDir+QuotaImageSuffix) {
+		t.Errorf("orphaned overlay is left after Doctor with DeleteOrphans")
+	}
+}
@@ -0,0 +1,269 @@
+package chrootprep
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// detectEnvironmentType detects whether the environment is normal or overlay
+func (op *operation) detectEnvironmentType(chrootDir string, overlayName string) EnvironmentType {
+	overlayDir := op.getOverlayDir(chrootDir, overlayName)
+	if dirExists(overlayDir) {
+		return OverlayEnvironment
+	}
+	// Check if base directory exists as normal chroot
+	if dirExists(chrootDir) {
+		return NormalEnvironment
+	}
+	return NormalEnvironment // default
+}
+
+// getOverlayDir returns the overlay directory path for a given chroot directory and name.
+// Overlays next to the base (<base>.<name>) take precedence over the overlay root.
+func (op *operation) getOverlayDir(chrootDir string, overlayName string) string {
+	if overlayName == "" {
+		return ""
+	}
+
+	siblingDir := fmt.Sprintf("%s.%s", chrootDir, overlayName)
+	if op.overlayRoot == "" || dirExists(siblingDir) {
+		return siblingDir
+	}
+
+	return filepath.Join(op.getOverlayRootDir(chrootDir), overlayName)
+}
+
+// getOverlayRootDir returns the directory holding a base's overlays under the overlay root
+func (op *operation) getOverlayRootDir(chrootDir string) string {
+	if op.overlayRoot == "" {
+		return ""
+	}
+	return filepath.Join(op.overlayRoot, filepath.Base(chrootDir))
+}
+
+// resolveEnvironment finds the base and name of the overlay a path belongs
+// to, when the path is an overlay directory or lies inside one, with the
+// overlay root to find it by name: the configured one, or the one it is
+// stored under when it is another.
+func (op *operation) resolveEnvironment(path string) (chrootDir string, overlayName string, overlayRoot string, ok bool) {
+	overlayDir, chrootDir, overlayName := overlayFromMetadata(path)
+	if overlayDir == "" {
+		overlayDir, chrootDir, overlayName = op.overlayFromMountTable(path)
+	}
+	if overlayDir == "" {
+		return "", "", "", false
+	}
+
+	// <root>/<base name>/<name>
+	overlayRoot = op.overlayRoot
+	parentDir := filepath.Dir(overlayDir)
+	if op.getOverlayDir(chrootDir, overlayName) != overlayDir && filepath.Base(parentDir) == filepath.Base(chrootDir) {
+		overlayRoot = filepath.Dir(parentDir)
+	}
+
+	return chrootDir, overlayName, overlayRoot, true
+}
+
+// overlayFromMetadata returns the closest overlay directory holding a path,
+// with the base and name recorded in its metadata
+func overlayFromMetadata(path string) (overlayDir string, chrootDir string, overlayName string) {
+	for dir := path; ; dir = filepath.Dir(dir) {
+		meta, err := readOverlayMetadataFile(filepath.Join(dir, MetadataFile))
+		if err == nil && meta != nil && meta.Base != "" && meta.Name != "" {
+			return dir, meta.Base, meta.Name
+		}
+
+		if dir == filepath.Dir(dir) {
+			return "", "", ""
+		}
+	}
+}
+
+// overlayFromMountTable returns the overlay directory, base and name of the
+// overlayfs mounted over a path, for overlays created without metadata. The
+// base is the lowest layer, and the name follows the <base>.<name> layout.
+func (op *operation) overlayFromMountTable(path string) (overlayDir string, chrootDir string, overlayName string) {
+	mounts, err := op.readMountInfo()
+	if err != nil {
+		return "", "", ""
+	}
+
+	// The innermost overlay mount holding the path
+	var found *MountInfo
+	for i, mount := range mounts {
+		if mount.FSType == MountTypeOverlay && isWithin(path, mount.MountPoint) &&
+			(found == nil || len(mount.MountPoint) >= len(found.MountPoint)) {
+			found = &mounts[i]
+		}
+	}
+	if found == nil || filepath.Base(found.MountPoint) != MergedDir {
+		return "", "", ""
+	}
+
+	lowers := strings.Split(mountOption(found.SuperOptions, "lowerdir"), ":")
+	overlayDir = filepath.Dir(found.MountPoint)
+	chrootDir = lowers[len(lowers)-1]
+	overlayName = strings.TrimPrefix(filepath.Base(overlayDir), filepath.Base(chrootDir)+".")
+	if chrootDir == "" || overlayName == "" {
+		return "", "", ""
+	}
+
+	return overlayDir, chrootDir, overlayName
+}
+
+// validateOverlayName checks that an overlay name can be used as a directory suffix
+func validateOverlayName(overlayName string) error {
+	if overlayName == "" || overlayName == "." || overlayName == ".." || strings.ContainsRune(overlayName, '/') {
+		return fmt.Errorf("%w '%s'", ErrInvalidName, overlayName)
+	}
+	return nil
+}
+
+// findOverlays returns the names of all overlays of a base directory,
+// both next to the base and under the overlay root
+func (op *operation) findOverlays(chrootDir string) []string {
+	names := findSiblingOverlays(chrootDir)
+
+	seen := make(map[string]bool)
+	for _, name := range names {
+		seen[name] = true
+	}
+
+	for _, name := range op.findRootOverlays(chrootDir) {
+		if !seen[name] {
+			names = append(names, name)
+		}
+	}
+
+	return names
+}
+
+// findSiblingOverlays returns the overlays stored next to the base as <base>.<name>
+func findSiblingOverlays(chrootDir string) []string {
+	parentDir := filepath.Dir(chrootDir)
+	entries, err := os.ReadDir(parentDir)
+	if err != nil {
+		return nil
+	}
+
+	baseName := filepath.Base(chrootDir)
+	prefix := baseName + "."
+
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		if !isOverlayDirectory(entry.Name(), baseName, prefix) {
+			continue
+		}
+
+		names = append(names, entry.Name()[len(prefix):])
+	}
+
+	return names
+}
+
+// findRootOverlays returns the overlays stored under the overlay root as <root>/<base name>/<name>
+func (op *operation) findRootOverlays(chrootDir string) []string {
+	rootDir := op.getOverlayRootDir(chrootDir)
+	if rootDir == "" {
+		return nil
+	}
+
+	entries, err := os.ReadDir(rootDir)
+	if err != nil {
+		return nil
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		// Bases with the same name in different directories share the root directory
+		meta, err := readOverlayMetadataFile(filepath.Join(rootDir, entry.Name(), MetadataFile))
+		if err == nil && meta != nil && meta.Base != chrootDir {
+			continue
+		}
+
+		names = append(names, entry.Name())
+	}
+
+	return names
+}
+
+// findMountedOverlays returns the overlays of a base that are currently mounted
+func (op *operation) findMountedOverlays(chrootDir string) []string {
+	var mounted []string
+	for _, name := range op.findOverlays(chrootDir) {
+		if op.isOverlaySetup(chrootDir, name) {
+			mounted = append(mounted, name)
+		}
+	}
+	return mounted
+}
+
+// isOverlayDirectory checks if a directory name matches overlay pattern
+func isOverlayDirectory(name, baseName, prefix string) bool {
+	return len(name) > len(baseName) && name[:len(prefix)] == prefix
+}
+
+// isOverlaySetup checks if a specific overlay is already set up
+func (op *operation) isOverlaySetup(chrootDir string, overlayName string) bool {
+	overlayDir := op.getOverlayDir(chrootDir, overlayName)
+	if overlayDir == "" {
+		return false
+	}
+	// Check if overlay directory exists and its root filesystem is set up
+	return dirExists(overlayDir) && op.getOverlayBackend(chrootDir, overlayName).IsMounted(chrootDir, overlayName)
+}
+
+// validateChrootStructure validates that the chroot directory has the required structure
+func validateChrootStructure(chrootDir string) error {
+	// Check if the directory exists
+	if !dirExists(chrootDir) {
+		return fmt.Errorf("chroot directory %s %w", chrootDir, ErrNotExist)
+	}
+
+	// For a minimal check, just ensure it's a directory
+	// Additional validation can be added here if needed
+	return nil
+}
+
+// validateOverlayStructure validates the overlay directory structure
+func (op *operation) validateOverlayStructure(chrootDir string, overlayName string) error {
+	overlayDir := op.getOverlayDir(chrootDir, overlayName)
+
+	// The layers of a size-limited overlay are only there once its image is attached
+	if err := op.attachOverlayStorage(chrootDir, overlayName); err != nil {
+		return err
+	}
+
+	// Check if overlay directory exists
+	if !dirExists(overlayDir) {
+		return fmt.Errorf("overlay directory %s %w", overlayDir, ErrNotExist)
+	}
+
+	// Check the storage of the overlay's backend
+	return op.getOverlayBackend(chrootDir, overlayName).Validate(chrootDir, overlayName)
+}
+
+// ensureChrootDirs ensures that essential directories exist in the chroot
+func ensureChrootDirs(chrootDir string) error {
+	// Essential directories that should exist in any chroot
+	essentialDirs := []string{"dev", "proc", "sys", "etc"}
+
+	for _, dir := range essentialDirs {
+		fullPath := filepath.Join(chrootDir, dir)
+		if err := ensureDir(fullPath, 0755); err != nil {
+			return fmt.Errorf("failed to create essential directory %s: %w", dir, err)
+		}
+	}
+
+	return nil
+}
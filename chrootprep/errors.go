@@ -0,0 +1,15 @@
+package chrootprep
+
+import "errors"
+
+// Errors returned by environment operations, wrapped with the environment
+// they concern. Test for them with errors.Is.
+var (
+	ErrInvalidName  = errors.New("invalid overlay name")
+	ErrNotExist     = errors.New("does not exist")
+	ErrExist        = errors.New("already exists")
+	ErrAlreadySetUp = errors.New("already set up")
+	ErrMounted      = errors.New("still mounted")
+	ErrInUse        = errors.New("in use")
+	ErrBaseChanged  = errors.New("base has changed")
+)
@@ -0,0 +1,288 @@
+package chrootprep
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// FakeMounter is an in-memory mount table standing in for the kernel, to
+// run environment operations in tests without root. Mounts are recorded
+// without changing the host, except that an overlay mount copies its
+// layers into the mountpoint so that its merged view has their contents,
+// a loop mount copies the files of its image there, and unmounting them or
+// a tmpfs empties the mountpoint again. Changes made in a merged view are
+// not copied up to the upper layer, those made in a writable loop mount
+// are kept as the files of its image.
+type FakeMounter struct {
+	mu     sync.Mutex
+	mounts []MountInfo
+	// loops maps the loop devices of loop mounts to their image
+	loops    map[string]string
+	nextLoop int
+	// inodes identifies the image files having a directory next to them
+	inodes map[string]uint64
+
+	// Busy makes normal unmounts of these paths fail with EBUSY, as when a
+	// process uses them. Lazy unmounts still succeed.
+	Busy map[string]bool
+	// Fail makes mounts at these paths fail with the error
+	Fail map[string]error
+	// Images maps image files to the directory holding their files. Other
+	// images are empty when first mounted, and keep their files in a
+	// hidden directory next to them.
+	Images map[string]string
+}
+
+// NewFakeMounter returns a FakeMounter with an empty mount table
+func NewFakeMounter() *FakeMounter {
+	return &FakeMounter{
+		loops:  make(map[string]string),
+		inodes: make(map[string]uint64),
+		Busy:   make(map[string]bool),
+		Fail:   make(map[string]error),
+		Images: make(map[string]string),
+	}
+}
+
+// top returns the index of the topmost mount at path, or -1
+func (f *FakeMounter) top(path string) int {
+	for i := len(f.mounts) - 1; i >= 0; i-- {
+		if f.mounts[i].MountPoint == path {
+			return i
+		}
+	}
+	return -1
+}
+
+// Mount records a mount, checking its arguments like mount(2) does
+func (f *FakeMounter) Mount(source string, target string, fstype string, flags uintptr, data string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.Fail[target]; err != nil {
+		return err
+	}
+	if !pathExists(target) {
+		return syscall.ENOENT
+	}
+
+	options := "rw"
+	if flags&syscall.MS_RDONLY != 0 {
+		options = "ro"
+	}
+
+	if flags&syscall.MS_REMOUNT != 0 {
+		i := f.top(target)
+		if i < 0 {
+			return syscall.EINVAL
+		}
+		f.mounts[i].Options = options
+		return nil
+	}
+
+	mount := MountInfo{Root: "/", MountPoint: target, Options: options, FSType: fstype, Source: source, SuperOptions: data}
+
+	switch {
+	case flags&syscall.MS_BIND != 0:
+		if !pathExists(source) {
+			return syscall.ENOENT
+		}
+
+		// A bind of a mountpoint shares its filesystem, a bind of a plain
+		// directory shows the directory as its root
+		mount.Root, mount.FSType, mount.Source, mount.SuperOptions = source, "none", "none", ""
+		if i := f.top(source); i >= 0 {
+			mount.Root, mount.FSType, mount.Source, mount.SuperOptions = f.mounts[i].Root, f.mounts[i].FSType, f.mounts[i].Source, f.mounts[i].SuperOptions
+		}
+
+	case fstype == MountTypeOverlay:
+		if err := fakeOverlayView(target, data); err != nil {
+			return err
+		}
+	}
+
+	f.mounts = append(f.mounts, mount)
+	return nil
+}
+
+// fakeOverlayView copies the layers of an overlay into its mountpoint, the
+// lowest first
+func fakeOverlayView(target string, data string) error {
+	lower := mountOption(data, "lowerdir")
+	if lower == "" {
+		return syscall.EINVAL
+	}
+
+	layers := strings.Split(lower, ":")
+	slices.Reverse(layers)
+	if upper := mountOption(data, "upperdir"); upper != "" {
+		layers = append(layers, upper)
+	}
+
+	for _, layer := range layers {
+		if !dirExists(layer) {
+			return syscall.ENOENT
+		}
+	}
+
+	for _, layer := range layers {
+		if err := exec.Command("cp", "--archive", layer+"/.", target).Run(); err != nil {
+			emptyDir(target)
+			return fmt.Errorf("failed to copy %s to %s: %w", layer, target, err)
+		}
+	}
+	return nil
+}
+
+// MountLoop records a loop mount of an image file, and copies the files
+// of the image into target
+func (f *FakeMounter) MountLoop(ctx context.Context, source string, target string, fstype string, flags uintptr) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := f.Fail[target]; err != nil {
+		return err
+	}
+	if !pathExists(target) || !fileExists(source) {
+		return syscall.ENOENT
+	}
+
+	files, err := f.imageFiles(source)
+	if err != nil {
+		return err
+	}
+	if err := exec.Command("cp", "--archive", files+"/.", target).Run(); err != nil {
+		emptyDir(target)
+		return fmt.Errorf("failed to copy %s to %s: %w", files, target, err)
+	}
+
+	options := "rw"
+	if flags&syscall.MS_RDONLY != 0 {
+		options = "ro"
+	}
+
+	device := fmt.Sprintf("/dev/loop%d", f.nextLoop)
+	f.nextLoop++
+	f.loops[device] = source
+	f.mounts = append(f.mounts, MountInfo{Root: "/", MountPoint: target, Options: options, FSType: fstype, Source: device, SuperOptions: options})
+	return nil
+}
+
+// imageFiles returns the directory holding the files of an image
+func (f *FakeMounter) imageFiles(image string) (string, error) {
+	if files := f.Images[image]; files != "" {
+		return files, nil
+	}
+
+	var st syscall.Stat_t
+	if err := syscall.Stat(image, &st); err != nil {
+		return "", err
+	}
+
+	// A new image file, such as one formatted again, has no files
+	files := filepath.Join(filepath.Dir(image), "."+filepath.Base(image)+".files")
+	if f.inodes[image] != st.Ino {
+		if err := os.RemoveAll(files); err != nil {
+			return "", err
+		}
+		f.inodes[image] = st.Ino
+	}
+
+	return files, ensureDir(files, 0755)
+}
+
+// Unmount removes the topmost mount at target. Mounts below target make
+// it fail with EBUSY, unless MNT_DETACH removes them as well.
+func (f *FakeMounter) Unmount(target string, flags int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	i := f.top(target)
+	if i < 0 {
+		return syscall.EINVAL
+	}
+
+	detach := flags&syscall.MNT_DETACH != 0
+	if f.Busy[target] && !detach {
+		return syscall.EBUSY
+	}
+
+	// Submounts come first, the latest first, so that a mount is emptied
+	// after those stacked in it
+	var removed []MountInfo
+	remaining := slices.Delete(slices.Clone(f.mounts), i, i+1)
+	for j := len(remaining) - 1; j >= 0; j-- {
+		if remaining[j].MountPoint != target && isWithin(remaining[j].MountPoint, target) {
+			if !detach {
+				return syscall.EBUSY
+			}
+			removed = append(removed, remaining[j])
+			remaining = slices.Delete(remaining, j, j+1)
+		}
+	}
+	removed = append(removed, f.mounts[i])
+	f.mounts = remaining
+
+	for _, mount := range removed {
+		// What was written to a writable loop mount is kept in its image
+		image, loop := f.loops[mount.Source]
+		if loop {
+			delete(f.loops, mount.Source)
+			if err := f.saveImageFiles(image, mount); err != nil {
+				return err
+			}
+		}
+
+		// What was written to an overlay or a tmpfs goes away with it
+		if (loop || mount.FSType == MountTypeOverlay || mount.FSType == MountTypeTmpfs) && f.top(mount.MountPoint) < 0 {
+			emptyDir(mount.MountPoint)
+		}
+	}
+	return nil
+}
+
+// saveImageFiles copies the files of a writable loop mount being unmounted
+// back to its image, unless the image was deleted meanwhile
+func (f *FakeMounter) saveImageFiles(image string, mount MountInfo) error {
+	if hasMountOption(mount.Options, "ro") || !fileExists(image) {
+		return nil
+	}
+
+	files, err := f.imageFiles(image)
+	if err != nil {
+		return err
+	}
+	if err := emptyDir(files); err != nil {
+		return err
+	}
+	if err := exec.Command("cp", "--archive", mount.MountPoint+"/.", files).Run(); err != nil {
+		return fmt.Errorf("failed to copy %s to %s: %w", mount.MountPoint, files, err)
+	}
+	return nil
+}
+
+// IsMountPoint checks if anything is mounted at path
+func (f *FakeMounter) IsMountPoint(path string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.top(path) >= 0
+}
+
+// MountInfo returns a copy of the mount table
+func (f *FakeMounter) MountInfo() ([]MountInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return slices.Clone(f.mounts), nil
+}
@@ -0,0 +1,133 @@
+package chrootprep
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestFakeMounterUnmount(t *testing.T) {
+	dir := t.TempDir()
+	proc := filepath.Join(dir, "proc")
+	if err := os.Mkdir(proc, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	mounter := NewFakeMounter()
+	if err := mounter.Mount("tmpfs", dir, MountTypeTmpfs, 0, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := mounter.Mount("proc", proc, "proc", 0, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mounter.Unmount(dir, 0); !errors.Is(err, syscall.EBUSY) {
+		t.Errorf("Unmount with a submount error = %v, want EBUSY", err)
+	}
+	if err := mounter.Unmount(dir, syscall.MNT_DETACH); err != nil {
+		t.Fatalf("lazy Unmount: %v", err)
+	}
+	if mounter.IsMountPoint(dir) || mounter.IsMountPoint(proc) {
+		t.Errorf("lazy Unmount left mounts below %s", dir)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("tmpfs mountpoint is not empty after Unmount")
+	}
+
+	if err := mounter.Unmount(dir, 0); !errors.Is(err, syscall.EINVAL) {
+		t.Errorf("Unmount of an unmounted path error = %v, want EINVAL", err)
+	}
+}
+
+func TestFakeMounterOverlay(t *testing.T) {
+	dir := t.TempDir()
+	lower, upper, work, merged := filepath.Join(dir, "lower"), filepath.Join(dir, "upper"), filepath.Join(dir, "work"), filepath.Join(dir, "merged")
+	for _, d := range []string{lower, upper, work, merged} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(lower, "file"), []byte("lower"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(upper, "file"), []byte("upper"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	mounter := NewFakeMounter()
+	data := "lowerdir=" + lower + ",upperdir=" + upper + ",workdir=" + work
+	if err := mounter.Mount("overlay", merged, MountTypeOverlay, 0, data); err != nil {
+		t.Fatalf("Mount: %v", err)
+	}
+
+	// The upper layer hides the lower one
+	if content, err := os.ReadFile(filepath.Join(merged, "file")); err != nil || string(content) != "upper" {
+		t.Errorf("merged file = %q, %v, want \"upper\"", content, err)
+	}
+
+	mounter.Busy[merged] = true
+	if err := mounter.Unmount(merged, 0); !errors.Is(err, syscall.EBUSY) {
+		t.Errorf("Unmount of a busy overlay error = %v, want EBUSY", err)
+	}
+	if err := mounter.Unmount(merged, syscall.MNT_DETACH); err != nil {
+		t.Fatalf("lazy Unmount: %v", err)
+	}
+	if entries, _ := os.ReadDir(merged); len(entries) != 0 {
+		t.Errorf("merged directory is not empty after Unmount")
+	}
+	if !fileExists(filepath.Join(upper, "file")) {
+		t.Errorf("upper layer was changed by Unmount")
+	}
+}
+
+func TestFakeMounterLoop(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	image, target := filepath.Join(dir, "storage.img"), filepath.Join(dir, "mnt")
+	if err := os.WriteFile(image, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(target, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	mounter := NewFakeMounter()
+	if err := mounter.MountLoop(ctx, image, target, ImageTypeExt4, 0); err != nil {
+		t.Fatalf("MountLoop: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(target, "file"), []byte("image"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mounter.Unmount(target, 0); err != nil {
+		t.Fatalf("Unmount: %v", err)
+	}
+	if entries, _ := os.ReadDir(target); len(entries) != 0 {
+		t.Errorf("loop mountpoint is not empty after Unmount")
+	}
+
+	// The files written are found again in the image, read-only this time
+	if err := mounter.MountLoop(ctx, image, target, ImageTypeExt4, syscall.MS_RDONLY); err != nil {
+		t.Fatalf("second MountLoop: %v", err)
+	}
+	if content, err := os.ReadFile(filepath.Join(target, "file")); err != nil || string(content) != "image" {
+		t.Errorf("file in the image = %q, %v, want \"image\"", content, err)
+	}
+	if err := os.Remove(filepath.Join(target, "file")); err != nil {
+		t.Fatal(err)
+	}
+	if err := mounter.Unmount(target, 0); err != nil {
+		t.Fatalf("second Unmount: %v", err)
+	}
+
+	// A read-only mount leaves the image as it was
+	if err := mounter.MountLoop(ctx, image, target, ImageTypeExt4, syscall.MS_RDONLY); err != nil {
+		t.Fatalf("third MountLoop: %v", err)
+	}
+	if !fileExists(filepath.Join(target, "file")) {
+		t.Errorf("change in a read-only loop mount reached the image")
+	}
+}
@@ -0,0 +1,88 @@
+package chrootprep
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"syscall"
+)
+
+// fingerprintSkip lists base paths left out of the fingerprint: mountpoints
+// whose contents come from the host, and files written by setup itself
+var fingerprintSkip = map[string]bool{
+	"dev":          true,
+	"proc":         true,
+	"sys":          true,
+	resolvConfName: true,
+}
+
+// baseFingerprint summarizes a base directory tree from the path, type,
+// permissions, ownership, size, mtime and inode of every entry
+func (op *operation) baseFingerprint(chrootDir string) (string, error) {
+	hasher := sha256.New()
+
+	// Image bases are fingerprinted through their mounted contents
+	chrootDir = op.getBaseRoot(chrootDir)
+
+	err := filepath.WalkDir(chrootDir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(chrootDir, path)
+		if err != nil {
+			return err
+		}
+
+		if fingerprintSkip[rel] {
+			// Keep the mountpoint itself, but not what is mounted on it
+			if entry.IsDir() {
+				fmt.Fprintf(hasher, "%s\x00dir\n", rel)
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		var st syscall.Stat_t
+		if err := syscall.Lstat(path, &st); err != nil {
+			return fmt.Errorf("failed to stat %s: %w", path, err)
+		}
+
+		// Directory mtimes change whenever entries are added or removed,
+		// which is already covered by the entries themselves
+		mtime := st.Mtim.Nano()
+		if entry.IsDir() {
+			mtime = 0
+		}
+
+		fmt.Fprintf(hasher, "%s\x00%o\x00%d\x00%d\x00%d\x00%d\x00%d\n", rel, st.Mode, st.Uid, st.Gid, st.Size, mtime, st.Ino)
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to fingerprint base %s: %w", chrootDir, err)
+	}
+
+	return "sha256:" + hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// checkBaseDrift compares the base against the fingerprint recorded in an
+// overlay's metadata. The fingerprint is recorded when missing, and
+// updated when drift is accepted.
+func (op *operation) checkBaseDrift(chrootDir string, meta *OverlayMetadata, acceptDrift bool) error {
+	fingerprint, err := op.baseFingerprint(chrootDir)
+	if err != nil {
+		return err
+	}
+
+	if meta.BaseFingerprint != "" && meta.BaseFingerprint != fingerprint {
+		if !acceptDrift {
+			return fmt.Errorf("overlay '%s': %w since it was created at %s, use -accept-drift to mount it anyway", meta.Name, ErrBaseChanged, chrootDir)
+		}
+		op.logf("Warning: base %s has changed since overlay '%s' was created, accepting the new base\n", chrootDir, meta.Name)
+	}
+
+	meta.BaseFingerprint = fingerprint
+	return nil
+}
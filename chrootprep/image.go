@@ -0,0 +1,185 @@
+package chrootprep
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// ImageMountRoot is where image bases are mounted while overlays use them,
+// unless Options.ImageMountRoot says otherwise
+const ImageMountRoot = "/run/chroot-prep/bases"
+
+// Filesystem types of image bases
+const (
+	ImageTypeSquashfs = "squashfs"
+	ImageTypeErofs    = "erofs"
+	ImageTypeExt4     = "ext4"
+)
+
+// isImageBase checks if a base is a filesystem image file rather than a directory
+func isImageBase(chrootDir string) bool {
+	return fileExists(chrootDir)
+}
+
+// getBaseRoot returns the directory holding the root filesystem of a base:
+// the managed mountpoint of an image base, or the base directory itself
+func (op *operation) getBaseRoot(chrootDir string) string {
+	if !isImageBase(chrootDir) {
+		return chrootDir
+	}
+
+	// Images with the same name in different directories get their own mountpoint
+	sum := sha256.Sum256([]byte(chrootDir))
+	return filepath.Join(op.imageMountRoot, filepath.Base(chrootDir)+"-"+hex.EncodeToString(sum[:4]))
+}
+
+// detectImageType identifies the filesystem of an image from its superblock magic
+func detectImageType(image string) (string, error) {
+	file, err := os.Open(image)
+	if err != nil {
+		return "", fmt.Errorf("failed to open image: %w", err)
+	}
+	defer file.Close()
+
+	// Images too small to hold an ext4 or erofs superblock are padded with zeroes
+	header := make([]byte, 2048)
+	if _, err := file.ReadAt(header, 0); err != nil && err != io.EOF {
+		return "", fmt.Errorf("failed to read image %s: %w", image, err)
+	}
+
+	switch {
+	case string(header[0:4]) == "hsqs":
+		return ImageTypeSquashfs, nil
+	case binary.LittleEndian.Uint32(header[1024:1028]) == 0xe0f5e1e2:
+		return ImageTypeErofs, nil
+	case binary.LittleEndian.Uint16(header[1024+56:1024+58]) == 0xef53:
+		return ImageTypeExt4, nil
+	}
+
+	return "", fmt.Errorf("%s is not a squashfs, erofs or ext4 image", image)
+}
+
+// attachImageBase loop-mounts an image base read-only at its managed
+// mountpoint, reusing an existing mount
+func (op *operation) attachImageBase(chrootDir string) error {
+	if !isImageBase(chrootDir) {
+		return nil
+	}
+
+	mountpoint := op.getBaseRoot(chrootDir)
+	if op.isMounted(mountpoint) {
+		return nil
+	}
+
+	fsType, err := detectImageType(chrootDir)
+	if err != nil {
+		return err
+	}
+
+	if err := ensureDir(mountpoint, 0755); err != nil {
+		return fmt.Errorf("failed to create image mountpoint: %w", err)
+	}
+
+	if err := op.mounter.MountLoop(op.ctx, chrootDir, mountpoint, fsType, syscall.MS_RDONLY); err != nil {
+		os.Remove(mountpoint)
+		return fmt.Errorf("failed to mount image %s: %w", chrootDir, err)
+	}
+
+	return nil
+}
+
+// detachImageBase unmounts an image base, which releases its loop device,
+// once no overlay on it is mounted anymore
+func (op *operation) detachImageBase(chrootDir string) error {
+	if !isImageBase(chrootDir) {
+		return nil
+	}
+
+	mountpoint := op.getBaseRoot(chrootDir)
+	if !op.isMounted(mountpoint) {
+		return nil
+	}
+
+	if mounted := op.findMountedOverlays(chrootDir); len(mounted) > 0 {
+		return nil
+	}
+
+	if err := op.umountPath(mountpoint); err != nil {
+		return err
+	}
+
+	return os.Remove(mountpoint)
+}
+
+// packImageTools maps image formats to the command lines building them
+var packImageTools = map[string]func(src, image string) []string{
+	ImageTypeSquashfs: func(src, image string) []string {
+		return []string{"mksquashfs", src, image, "-noappend"}
+	},
+	ImageTypeErofs: func(src, image string) []string {
+		return []string{"mkfs.erofs", image, src}
+	},
+}
+
+// packImageFormat returns the image format to build, from the explicit
+// format or the extension of the image name
+func packImageFormat(image string, format string) (string, error) {
+	if format == "" {
+		switch strings.ToLower(filepath.Ext(image)) {
+		case ".squashfs", ".sqfs":
+			format = ImageTypeSquashfs
+		case ".erofs":
+			format = ImageTypeErofs
+		default:
+			return "", fmt.Errorf("cannot tell the image format from %s, use -format squashfs or -format erofs", image)
+		}
+	}
+
+	if _, ok := packImageTools[format]; !ok {
+		return "", fmt.Errorf("unsupported image format '%s' (use squashfs or erofs)", format)
+	}
+
+	return format, nil
+}
+
+// packBase builds a compressed read-only image from a directory base
+func (op *operation) packBase(chrootDir string, image string, format string) error {
+	if err := validateChrootStructure(chrootDir); err != nil {
+		return err
+	}
+
+	// Contents of /proc, /dev and /sys must not end up in the image
+	if err := op.validateNotMounted(chrootDir); err != nil {
+		return err
+	}
+
+	// The image would be packed into itself
+	if strings.HasPrefix(image, chrootDir+string(filepath.Separator)) {
+		return fmt.Errorf("image %s must not be inside %s", image, chrootDir)
+	}
+
+	if pathExists(image) {
+		return fmt.Errorf("%s %w", image, ErrExist)
+	}
+
+	format, err := packImageFormat(image, format)
+	if err != nil {
+		return err
+	}
+
+	args := packImageTools[format](chrootDir, image)
+	cmd := op.command(args[0], args[1:]...)
+	if err := op.runCommand(cmd); err != nil {
+		removeIfExists(image)
+		return fmt.Errorf("failed to build %s image: %w", format, err)
+	}
+
+	return nil
+}
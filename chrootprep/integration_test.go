@@ -0,0 +1,227 @@
+//go:build integration
+
+package chrootprep
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// usernsEnv marks the test binary re-run inside its own namespaces
+const usernsEnv = "CHROOT_PREP_USERNS"
+
+// TestMain runs the integration tests in new user and mount namespaces, as
+// root of a user namespace, so that they mount real filesystems without
+// root and without touching the mount table of the host. A pid namespace is
+// needed as well for proc to be mounted.
+func TestMain(m *testing.M) {
+	if os.Getenv(usernsEnv) == "" {
+		if err := exec.Command("unshare", "-rmpf", "true").Run(); err != nil {
+			fmt.Fprintf(os.Stderr, "skipping integration tests: cannot create user and mount namespaces: %v\n", err)
+			os.Exit(0)
+		}
+
+		cmd := exec.Command("unshare", append([]string{"-rmpf", "--"}, os.Args...)...)
+		cmd.Env = append(os.Environ(), usernsEnv+"=1")
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+		if err := cmd.Run(); err != nil {
+			var exitErr *exec.ExitError
+			if errors.As(err, &exitErr) {
+				os.Exit(exitErr.ExitCode())
+			}
+			fmt.Fprintf(os.Stderr, "failed to run tests in namespaces: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	uncover, err := coverLockedMounts()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to prepare mount namespace: %v\n", err)
+		os.Exit(1)
+	}
+	code := m.Run()
+	uncover()
+	os.Exit(code)
+}
+
+// coverLockedMounts covers /dev and /sys with plain directories. Mounts
+// inherited from the host are locked in a user namespace, and a bind of a
+// tree containing them without its submounts fails with EINVAL. The
+// returned function undoes it.
+func coverLockedMounts() (func(), error) {
+	cover, err := os.MkdirTemp("", "chroot-prep-cover-")
+	if err != nil {
+		return nil, err
+	}
+
+	dev, sys := filepath.Join(cover, "dev"), filepath.Join(cover, "sys")
+	null := filepath.Join(dev, "null")
+	uncover := func() {
+		for _, path := range []string{"/dev", "/sys", null} {
+			syscall.Unmount(path, syscall.MNT_DETACH)
+		}
+		os.RemoveAll(cover)
+	}
+
+	for _, dir := range []string{dev, sys} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			uncover()
+			return nil, err
+		}
+	}
+
+	// Keep /dev/null, which commands run by the tests need
+	if err := os.WriteFile(null, nil, 0644); err != nil {
+		uncover()
+		return nil, err
+	}
+	if err := syscall.Mount("/dev/null", null, "", syscall.MS_BIND, ""); err != nil {
+		uncover()
+		return nil, fmt.Errorf("failed to bind mount /dev/null: %w", err)
+	}
+
+	if err := syscall.Mount(sys, "/sys", "", syscall.MS_BIND, ""); err != nil {
+		uncover()
+		return nil, fmt.Errorf("failed to cover /sys: %w", err)
+	}
+	if err := syscall.Mount(dev, "/dev", "", syscall.MS_BIND, ""); err != nil {
+		uncover()
+		return nil, fmt.Errorf("failed to cover /dev: %w", err)
+	}
+
+	return uncover, nil
+}
+
+// newSystemEnvironment returns an environment of base mounted in the mount
+// namespace of the tests, cleaned up at the end of the test
+func newSystemEnvironment(t *testing.T, base string, overlayName string) *Environment {
+	t.Helper()
+
+	env, err := New(base, overlayName, Options{Logger: testLogger{t}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Leave nothing mounted in the temporary directory when a test fails
+	t.Cleanup(func() {
+		if isEnvironmentSetup(env) {
+			env.Cleanup(context.Background())
+		}
+	})
+
+	return env
+}
+
+// isEnvironmentSetup checks if the essential filesystems of env are mounted
+func isEnvironmentSetup(env *Environment) bool {
+	dir := env.Dir()
+	if env.Overlay() != "" {
+		_, _, dir = env.newOperation(context.Background()).getOverlayPaths(env.Dir(), env.Overlay())
+	}
+	return SystemMounter{}.IsMountPoint(filepath.Join(dir, "proc"))
+}
+
+func TestIntegrationNormal(t *testing.T) {
+	ctx := context.Background()
+	base := newTestBase(t)
+	env := newSystemEnvironment(t, base, "")
+
+	if err := env.Setup(ctx, SetupOptions{}); err != nil {
+		t.Fatalf("Setup: %v", err)
+	}
+	if !dirExists(filepath.Join(base, "proc", "self")) {
+		t.Errorf("proc is not mounted in the environment")
+	}
+	if !pathExists(filepath.Join(base, "dev", "null")) {
+		t.Errorf("dev is not mounted in the environment")
+	}
+
+	if err := env.Cleanup(ctx); err != nil {
+		t.Fatalf("Cleanup: %v", err)
+	}
+	if isEnvironmentSetup(env) {
+		t.Errorf("environment is still mounted after Cleanup")
+	}
+}
+
+func TestIntegrationOverlay(t *testing.T) {
+	ctx := context.Background()
+	base := newTestBase(t)
+	env := newSystemEnvironment(t, base, "dev")
+	op := env.newOperation(context.Background())
+	upper, _, merged := op.getOverlayPaths(base, "dev")
+
+	if err := env.Setup(ctx, SetupOptions{}); err != nil {
+		t.Fatalf("Setup: %v", err)
+	}
+	if !dirExists(filepath.Join(merged, "proc", "self")) {
+		t.Errorf("proc is not mounted in the merged view")
+	}
+
+	// Changes land in the upper layer and leave the base alone
+	if err := os.WriteFile(filepath.Join(merged, "etc", "motd"), []byte("overlay\n"), 0644); err != nil {
+		t.Fatalf("failed to write in the merged view: %v", err)
+	}
+	if !fileExists(filepath.Join(upper, "etc", "motd")) {
+		t.Errorf("change in the merged view is not in the upper layer")
+	}
+	if fileExists(filepath.Join(base, "etc", "motd")) {
+		t.Errorf("change in the merged view reached the base")
+	}
+
+	if err := env.Cleanup(ctx); err != nil {
+		t.Fatalf("Cleanup: %v", err)
+	}
+	if op.isOverlaySetup(base, "dev") || fileExists(filepath.Join(merged, "etc", "hostname")) {
+		t.Errorf("overlay is still mounted after Cleanup")
+	}
+	if !fileExists(filepath.Join(upper, "etc", "motd")) {
+		t.Errorf("upper layer was lost by Cleanup")
+	}
+
+	if err := env.Setup(ctx, SetupOptions{}); err != nil {
+		t.Fatalf("second Setup: %v", err)
+	}
+	if err := env.Remove(ctx, RemoveOptions{}); err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	if pathExists(op.getOverlayDir(base, "dev")) {
+		t.Errorf("overlay directory still exists after Remove")
+	}
+}
+
+func TestIntegrationReadOnlyOverlay(t *testing.T) {
+	ctx := context.Background()
+	base := newTestBase(t)
+	env := newSystemEnvironment(t, base, "ro")
+	op := env.newOperation(context.Background())
+	_, _, merged := op.getOverlayPaths(base, "ro")
+
+	// A read-only setup does not create the overlay
+	if err := env.Setup(ctx, SetupOptions{}); err != nil {
+		t.Fatalf("Setup: %v", err)
+	}
+	if err := env.Cleanup(ctx); err != nil {
+		t.Fatalf("Cleanup: %v", err)
+	}
+
+	if err := env.Setup(ctx, SetupOptions{ReadOnly: true}); err != nil {
+		t.Fatalf("read-only Setup: %v", err)
+	}
+
+	err := os.WriteFile(filepath.Join(merged, "etc", "motd"), []byte("overlay\n"), 0644)
+	if !errors.Is(err, syscall.EROFS) {
+		t.Errorf("write in a read-only overlay error = %v, want EROFS", err)
+	}
+
+	if err := env.Cleanup(ctx); err != nil {
+		t.Fatalf("Cleanup: %v", err)
+	}
+}
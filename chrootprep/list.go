@@ -0,0 +1,122 @@
+package chrootprep
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Listing holds the versions and overlays of a base, as returned by List
+type Listing struct {
+	Base     string
+	Versions []BaseVersion
+	Overlays []OverlayInfo
+}
+
+// OverlayInfo describes an overlay of a base
+type OverlayInfo struct {
+	Name    string
+	Dir     string
+	Mounted bool
+	// Parents lists the overlays this overlay is stacked on, nearest first
+	Parents []string
+	// Usage is nil when the space used by the overlay is not tracked
+	Usage *Usage
+}
+
+// OverlayStatus describes the state of an overlay, as returned by Status
+type OverlayStatus struct {
+	OverlayInfo
+	Base     string
+	ReadOnly bool
+	// Storage says where the overlay keeps its changes (disk, tmpfs, ...)
+	Storage string
+	Options []string
+	// Created is zero for overlays created before metadata was kept
+	Created time.Time
+}
+
+// Usage is the space used by an overlay, and its size limit when it is
+// backed by a tmpfs or a storage image (0 when unlimited)
+type Usage struct {
+	Used  int64
+	Limit int64
+}
+
+// String formats the usage for display, as "-" when it is not tracked
+func (u *Usage) String() string {
+	if u == nil {
+		return "-"
+	}
+	if u.Limit == 0 {
+		return formatSize(u.Used)
+	}
+	return fmt.Sprintf("%s / %s (%d%%)", formatSize(u.Used), formatSize(u.Limit), u.Used*100/u.Limit)
+}
+
+// listOverlays returns the versions and overlays of a base directory and their state
+func (op *operation) listOverlays(chrootDir string) *Listing {
+	names := op.findOverlays(chrootDir)
+	sort.Strings(names)
+
+	listing := &Listing{Base: chrootDir, Versions: findVersions(chrootDir)}
+	for _, name := range names {
+		listing.Overlays = append(listing.Overlays, op.overlayInfo(chrootDir, name))
+	}
+	return listing
+}
+
+// overlayInfo returns the state, parents and usage of an overlay
+func (op *operation) overlayInfo(chrootDir string, overlayName string) OverlayInfo {
+	info := OverlayInfo{
+		Name:    overlayName,
+		Dir:     op.getOverlayDir(chrootDir, overlayName),
+		Mounted: op.isOverlaySetup(chrootDir, overlayName),
+	}
+
+	if meta, err := op.readOverlayMetadata(chrootDir, overlayName); err == nil && meta != nil {
+		info.Parents = meta.Parents
+	}
+
+	if used, limit, err := op.overlayUsage(chrootDir, overlayName); err == nil {
+		info.Usage = &Usage{Used: used, Limit: limit}
+	}
+
+	return info
+}
+
+// overlayStatus returns the state, storage and usage of an overlay
+func (op *operation) overlayStatus(chrootDir string, overlayName string) (*OverlayStatus, error) {
+	if err := op.validateOverlayStructure(chrootDir, overlayName); err != nil {
+		return nil, err
+	}
+
+	meta, err := op.readOverlayMetadata(chrootDir, overlayName)
+	if err != nil {
+		return nil, err
+	}
+
+	status := &OverlayStatus{OverlayInfo: op.overlayInfo(chrootDir, overlayName), Base: chrootDir}
+	if status.Mounted {
+		_, _, merged := op.getOverlayPaths(chrootDir, overlayName)
+		status.ReadOnly = op.isReadOnlyMount(merged)
+	}
+
+	status.Storage = "disk"
+	if meta != nil && meta.Backend == BackendBtrfs {
+		status.Storage = "btrfs snapshot"
+	} else if meta != nil && meta.Backend == BackendCopy {
+		status.Storage = "copy of the base"
+	} else if op.isTmpfsOverlay(chrootDir, overlayName) {
+		status.Storage = "tmpfs"
+	} else if op.isQuotaOverlay(chrootDir, overlayName) {
+		status.Storage = "image " + op.getQuotaImagePath(chrootDir, overlayName)
+	}
+
+	if meta != nil {
+		status.Options = meta.Options
+		status.Created = meta.Created
+	}
+
+	return status, nil
+}
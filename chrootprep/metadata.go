@@ -0,0 +1,152 @@
+package chrootprep
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// OverlayMetadata records how a named overlay was created
+type OverlayMetadata struct {
+	Name string `json:"name"`
+	Base string `json:"base"`
+	// Backend is the layering backend storing the overlay, empty for overlayfs
+	Backend string `json:"backend,omitempty"`
+	// Parents lists the overlays this overlay is stacked on, nearest first
+	Parents []string `json:"parents,omitempty"`
+	// Options are the extra overlayfs mount options used on every mount
+	Options []string `json:"options,omitempty"`
+	// BaseFingerprint summarizes the base at creation, to detect later changes
+	BaseFingerprint string    `json:"base_fingerprint,omitempty"`
+	Created         time.Time `json:"created"`
+}
+
+// getMetadataPath returns the path of an overlay's metadata file
+func (op *operation) getMetadataPath(chrootDir string, overlayName string) string {
+	return filepath.Join(op.getOverlayDir(chrootDir, overlayName), MetadataFile)
+}
+
+// readOverlayMetadata reads an overlay's metadata, returning nil if it has none
+func (op *operation) readOverlayMetadata(chrootDir string, overlayName string) (*OverlayMetadata, error) {
+	meta, err := readOverlayMetadataFile(op.getMetadataPath(chrootDir, overlayName))
+	if err != nil {
+		return nil, fmt.Errorf("overlay '%s': %w", overlayName, err)
+	}
+	return meta, nil
+}
+
+// readOverlayMetadataFile reads a metadata file, returning nil if it does not exist
+func readOverlayMetadataFile(path string) (*OverlayMetadata, error) {
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read metadata: %w", err)
+	}
+
+	var meta OverlayMetadata
+	if err := json.Unmarshal(content, &meta); err != nil {
+		return nil, fmt.Errorf("failed to parse metadata %s: %w", path, err)
+	}
+
+	return &meta, nil
+}
+
+// loadOverlayMetadata reads an overlay's metadata, falling back to a
+// minimal record for overlays created before metadata was kept
+func (op *operation) loadOverlayMetadata(chrootDir string, overlayName string) (*OverlayMetadata, error) {
+	meta, err := op.readOverlayMetadata(chrootDir, overlayName)
+	if err != nil {
+		return nil, err
+	}
+
+	if meta == nil {
+		meta = &OverlayMetadata{Name: overlayName, Base: chrootDir}
+	}
+	return meta, nil
+}
+
+// writeOverlayMetadata stores an overlay's metadata in its overlay directory
+func (op *operation) writeOverlayMetadata(chrootDir string, meta *OverlayMetadata) error {
+	content, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode metadata: %w", err)
+	}
+
+	path := op.getMetadataPath(chrootDir, meta.Name)
+	if err := os.WriteFile(path, append(content, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// newOverlayMetadata creates metadata for a new overlay, optionally stacked on a parent overlay
+func (op *operation) newOverlayMetadata(chrootDir string, overlayName string, parentName string, options []string) (*OverlayMetadata, error) {
+	meta := &OverlayMetadata{
+		Name:    overlayName,
+		Base:    chrootDir,
+		Options: options,
+		Created: time.Now().UTC(),
+	}
+
+	if parentName == "" {
+		return meta, nil
+	}
+
+	if parentName == overlayName {
+		return nil, fmt.Errorf("overlay '%s' cannot be stacked on itself", overlayName)
+	}
+
+	if err := op.validateOverlayStructure(chrootDir, parentName); err != nil {
+		return nil, fmt.Errorf("parent overlay '%s' is not usable: %w", parentName, err)
+	}
+
+	parentMeta, err := op.readOverlayMetadata(chrootDir, parentName)
+	if err != nil {
+		return nil, err
+	}
+
+	meta.Parents = []string{parentName}
+	if parentMeta != nil {
+		for _, name := range parentMeta.Parents {
+			if name == overlayName {
+				return nil, fmt.Errorf("overlay '%s' is already a parent of '%s'", overlayName, parentName)
+			}
+		}
+		meta.Parents = append(meta.Parents, parentMeta.Parents...)
+		// Overlays are stacked within a single backend
+		meta.Backend = parentMeta.Backend
+	}
+
+	return meta, nil
+}
+
+// findDependentOverlays returns the overlays stacked directly or indirectly on an overlay
+func (op *operation) findDependentOverlays(chrootDir string, overlayName string) ([]string, error) {
+	var dependents []string
+	for _, name := range op.findOverlays(chrootDir) {
+		var meta *OverlayMetadata
+		// A detached size-limited overlay keeps its metadata inside its image
+		err := op.withOverlayStorage(op.getOverlayDir(chrootDir, name), func() error {
+			meta, _ = op.readOverlayMetadata(chrootDir, name)
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to check whether overlay '%s' depends on '%s': %w", name, overlayName, err)
+		}
+		if meta == nil {
+			continue
+		}
+		for _, parent := range meta.Parents {
+			if parent == overlayName {
+				dependents = append(dependents, name)
+				break
+			}
+		}
+	}
+	return dependents, nil
+}
@@ -0,0 +1,388 @@
+package chrootprep
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// MountInfo is a single entry of the mount table, as found in
+// /proc/self/mountinfo
+type MountInfo struct {
+	Root         string
+	MountPoint   string
+	Options      string
+	FSType       string
+	Source       string
+	SuperOptions string
+}
+
+// mountProc mounts procfs to the target directory
+func (op *operation) mountProc(target string, readOnly bool) error {
+	if op.isMounted(target) {
+		op.logf("%s is already mounted, skipping...\n", target)
+		return nil
+	}
+
+	var flags uintptr
+	if readOnly {
+		flags = syscall.MS_RDONLY
+	}
+
+	if err := op.mounter.Mount("none", target, "proc", flags, ""); err != nil {
+		return fmt.Errorf("failed to mount proc at %s: %w", target, err)
+	}
+
+	return nil
+}
+
+// mountDev bind mounts /dev to the target directory
+func (op *operation) mountDev(target string) error {
+	if op.isMounted(target) {
+		op.logf("%s is already mounted, skipping...\n", target)
+		return nil
+	}
+
+	if err := op.mounter.Mount("/dev", target, "none", syscall.MS_BIND, ""); err != nil {
+		return fmt.Errorf("failed to mount dev at %s: %w", target, err)
+	}
+
+	return nil
+}
+
+// mountSys bind mounts /sys to the target directory
+func (op *operation) mountSys(target string, readOnly bool) error {
+	if op.isMounted(target) {
+		op.logf("%s is already mounted, skipping...\n", target)
+		return nil
+	}
+
+	if readOnly {
+		return op.bindMountReadOnly("/sys", target)
+	}
+
+	if err := op.mounter.Mount("/sys", target, "none", syscall.MS_BIND, ""); err != nil {
+		return fmt.Errorf("failed to mount sys at %s: %w", target, err)
+	}
+
+	return nil
+}
+
+// mountEssentialFS mounts all essential filesystems (/proc, /dev, /sys).
+// With readOnly, /proc and /sys are mounted read-only; /dev stays writable
+// so that device nodes such as /dev/null keep working.
+func (op *operation) mountEssentialFS(chrootDir string, readOnly bool) error {
+	// Verify required directories exist
+	requiredDirs := []string{"dev", "proc", "sys"}
+	for _, dir := range requiredDirs {
+		fullPath := filepath.Join(chrootDir, dir)
+		if !dirExists(fullPath) {
+			return fmt.Errorf("required directory %s does not exist in chroot environment", dir)
+		}
+	}
+
+	// Mount proc
+	if err := op.mountProc(filepath.Join(chrootDir, "proc"), readOnly); err != nil {
+		return err
+	}
+
+	// Mount dev
+	if err := op.mountDev(filepath.Join(chrootDir, "dev")); err != nil {
+		return err
+	}
+
+	// Mount sys
+	if err := op.mountSys(filepath.Join(chrootDir, "sys"), readOnly); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// umountEssentialFS unmounts all essential filesystems
+func (op *operation) umountEssentialFS(chrootDir string) error {
+	// Unmount in reverse order to handle dependencies
+	mounts := []string{
+		filepath.Join(chrootDir, "sys"),
+		filepath.Join(chrootDir, "proc"),
+		filepath.Join(chrootDir, "dev"),
+	}
+
+	var firstErr error
+	for _, mountpoint := range mounts {
+		if !op.isMounted(mountpoint) {
+			op.logf("%s is not mounted, skipping...\n", mountpoint)
+			continue
+		}
+
+		if err := op.umountPath(mountpoint); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			// Continue unmounting other filesystems
+		}
+	}
+
+	return firstErr
+}
+
+// mountOverlayFS mounts an overlay filesystem with optional extra mount options
+func (op *operation) mountOverlayFS(lower, upper, work, merged string, options []string) error {
+	if op.isMounted(merged) {
+		return fmt.Errorf("overlay is already mounted at %s", merged)
+	}
+
+	// Construct mount options
+	opts := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", lower, upper, work)
+	for _, option := range options {
+		opts += "," + option
+	}
+
+	// Mount overlay
+	if err := op.mounter.Mount("overlay", merged, "overlay", 0, opts); err != nil {
+		return fmt.Errorf("failed to mount overlay: %w", err)
+	}
+
+	return nil
+}
+
+// probeOverlayFS checks that an overlay filesystem with its upper layer in
+// dir can be mounted, by mounting and unmounting a throwaway one
+func (op *operation) probeOverlayFS(dir string) error {
+	if err := ensureDir(dir, 0755); err != nil {
+		return err
+	}
+
+	probe, err := os.MkdirTemp(dir, ".chroot-prep-probe-")
+	if err != nil {
+		return fmt.Errorf("failed to create probe directory: %w", err)
+	}
+	defer os.RemoveAll(probe)
+
+	paths := make(map[string]string)
+	for _, name := range []string{"lower", UpperDir, WorkDir, MergedDir} {
+		paths[name] = filepath.Join(probe, name)
+		if err := os.Mkdir(paths[name], 0755); err != nil {
+			return fmt.Errorf("failed to create probe directory: %w", err)
+		}
+	}
+
+	opts := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", paths["lower"], paths[UpperDir], paths[WorkDir])
+	if err := op.mounter.Mount("overlay", paths[MergedDir], "overlay", 0, opts); err != nil {
+		return err
+	}
+
+	return op.mounter.Unmount(paths[MergedDir], 0)
+}
+
+// mountOverlayFSReadOnly mounts an overlay filesystem made only of lower
+// directories, so that the merged view cannot be modified
+func (op *operation) mountOverlayFSReadOnly(lower, merged string, options []string) error {
+	if op.isMounted(merged) {
+		return fmt.Errorf("overlay is already mounted at %s", merged)
+	}
+
+	opts := "lowerdir=" + lower
+	for _, option := range options {
+		opts += "," + option
+	}
+
+	if err := op.mounter.Mount("overlay", merged, "overlay", syscall.MS_RDONLY, opts); err != nil {
+		return fmt.Errorf("failed to mount read-only overlay: %w", err)
+	}
+
+	return nil
+}
+
+// bindMountReadOnly bind mounts source onto target and makes the bind read-only
+func (op *operation) bindMountReadOnly(source, target string) error {
+	if err := op.mounter.Mount(source, target, "none", syscall.MS_BIND, ""); err != nil {
+		return fmt.Errorf("failed to bind mount %s at %s: %w", source, target, err)
+	}
+
+	// The read-only flag only takes effect when the bind is remounted
+	flags := uintptr(syscall.MS_REMOUNT | syscall.MS_BIND | syscall.MS_RDONLY)
+	if err := op.mounter.Mount("none", target, "none", flags, ""); err != nil {
+		op.mounter.Unmount(target, 0)
+		return fmt.Errorf("failed to make %s read-only: %w", target, err)
+	}
+
+	return nil
+}
+
+// mountTmpfs mounts a tmpfs at the target directory
+func (op *operation) mountTmpfs(target string, size string) error {
+	if op.isMounted(target) {
+		return fmt.Errorf("%s is already mounted", target)
+	}
+
+	opts := "mode=0755"
+	if size != "" {
+		opts += ",size=" + size
+	}
+
+	if err := op.mounter.Mount("tmpfs", target, MountTypeTmpfs, 0, opts); err != nil {
+		return fmt.Errorf("failed to mount tmpfs at %s: %w", target, err)
+	}
+
+	return nil
+}
+
+// umountPath unmounts a filesystem at the given path
+func (op *operation) umountPath(path string) error {
+	// Try normal unmount first
+	err := op.mounter.Unmount(path, 0)
+	if err == nil {
+		return nil
+	}
+
+	// Normal unmount failed, try lazy unmount
+	op.logf("Normal unmount failed for %s, trying lazy unmount...\n", path)
+	if err := op.mounter.Unmount(path, syscall.MNT_DETACH); err != nil {
+		return fmt.Errorf("failed to unmount %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// isMounted checks if a path is mounted
+func (op *operation) isMounted(mountpoint string) bool {
+	return op.mounter.IsMountPoint(mountpoint)
+}
+
+// readMountInfo returns the mount table of the current mount namespace
+func (op *operation) readMountInfo() ([]MountInfo, error) {
+	return op.mounter.MountInfo()
+}
+
+// parseMountInfo parses a mount table in the format of /proc/self/mountinfo
+func parseMountInfo(r io.Reader) ([]MountInfo, error) {
+	var mounts []MountInfo
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		// Format: id parent major:minor root mountpoint options [optional...] - fstype source superoptions
+		fields := strings.Fields(scanner.Text())
+		sep := -1
+		for i, field := range fields {
+			if field == "-" {
+				sep = i
+				break
+			}
+		}
+		if sep < 6 || len(fields) < sep+4 {
+			continue
+		}
+
+		mounts = append(mounts, MountInfo{
+			Root:         unescapeMountField(fields[3]),
+			MountPoint:   unescapeMountField(fields[4]),
+			Options:      fields[5],
+			FSType:       fields[sep+1],
+			Source:       unescapeMountField(fields[sep+2]),
+			SuperOptions: fields[sep+3],
+		})
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read mount table: %w", err)
+	}
+
+	return mounts, nil
+}
+
+// findMount returns the topmost mount at mountpoint, or nil if nothing is mounted there
+func (op *operation) findMount(mountpoint string) *MountInfo {
+	mounts, err := op.readMountInfo()
+	if err != nil {
+		return nil
+	}
+
+	// Later entries are stacked on top of earlier ones
+	for i := len(mounts) - 1; i >= 0; i-- {
+		if mounts[i].MountPoint == mountpoint {
+			return &mounts[i]
+		}
+	}
+
+	return nil
+}
+
+// isReadOnlyMount checks if the topmost mount at mountpoint is read-only
+func (op *operation) isReadOnlyMount(mountpoint string) bool {
+	mount := op.findMount(mountpoint)
+	return mount != nil && hasMountOption(mount.Options, "ro")
+}
+
+// isReadOnlyBindMount checks if the topmost mount at path is a read-only
+// bind mount of the directory itself, as created by bindMountReadOnly
+func (op *operation) isReadOnlyBindMount(path string) bool {
+	mounts, err := op.readMountInfo()
+	if err != nil {
+		return false
+	}
+
+	var stacked []MountInfo
+	for _, mount := range mounts {
+		if mount.MountPoint == path {
+			stacked = append(stacked, mount)
+		}
+	}
+
+	if len(stacked) == 0 {
+		return false
+	}
+
+	top := stacked[len(stacked)-1]
+	if !hasMountOption(top.Options, "ro") || !strings.HasSuffix(path, top.Root) {
+		return false
+	}
+
+	// A bind of a plain directory shows the directory as its root, while a
+	// bind of a whole filesystem is stacked on top of the original mount
+	return top.Root != "/" || len(stacked) > 1
+}
+
+// hasMountOption checks if a comma separated mount option string contains option
+func hasMountOption(options string, option string) bool {
+	for _, o := range strings.Split(options, ",") {
+		if o == option {
+			return true
+		}
+	}
+	return false
+}
+
+// mountOption returns the value of key in a comma separated mount option string
+func mountOption(options string, key string) string {
+	for _, option := range strings.Split(options, ",") {
+		if value, ok := strings.CutPrefix(option, key+"="); ok {
+			return value
+		}
+	}
+	return ""
+}
+
+// unescapeMountField decodes the octal escapes (e.g. \040 for space) used in the mount table
+func unescapeMountField(field string) string {
+	if !strings.Contains(field, "\\") {
+		return field
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(field); i++ {
+		if field[i] == '\\' && i+3 < len(field) {
+			if n, err := strconv.ParseUint(field[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(field[i])
+	}
+	return b.String()
+}
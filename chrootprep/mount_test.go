@@ -0,0 +1,97 @@
+package chrootprep
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestParseMountInfo(t *testing.T) {
+	table := `22 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw,errors=remount-ro
+36 22 0:32 / /srv/my\040base/proc rw,nosuid - proc proc rw
+37 22 0:33 / /srv/merged rw master:2 unbindable - overlay overlay rw,lowerdir=/srv/base,upperdir=/srv/upper,workdir=/srv/work
+38 22 8:1 /srv/base /srv/base ro,relatime - ext4 /dev/sda1 rw
+truncated line
+`
+
+	mounts, err := parseMountInfo(strings.NewReader(table))
+	if err != nil {
+		t.Fatalf("parseMountInfo: %v", err)
+	}
+
+	want := []MountInfo{
+		{Root: "/", MountPoint: "/", Options: "rw,relatime", FSType: "ext4", Source: "/dev/sda1", SuperOptions: "rw,errors=remount-ro"},
+		{Root: "/", MountPoint: "/srv/my base/proc", Options: "rw,nosuid", FSType: "proc", Source: "proc", SuperOptions: "rw"},
+		{Root: "/", MountPoint: "/srv/merged", Options: "rw", FSType: "overlay", Source: "overlay", SuperOptions: "rw,lowerdir=/srv/base,upperdir=/srv/upper,workdir=/srv/work"},
+		{Root: "/srv/base", MountPoint: "/srv/base", Options: "ro,relatime", FSType: "ext4", Source: "/dev/sda1", SuperOptions: "rw"},
+	}
+	if len(mounts) != len(want) {
+		t.Fatalf("parseMountInfo returned %d mounts, want %d: %+v", len(mounts), len(want), mounts)
+	}
+	for i := range want {
+		if mounts[i] != want[i] {
+			t.Errorf("mount %d = %+v, want %+v", i, mounts[i], want[i])
+		}
+	}
+}
+
+func TestMountOptions(t *testing.T) {
+	options := "rw,lowerdir=/a:/b,upperdir=/u,workdir=/w,userxattr"
+
+	if got := mountOption(options, "lowerdir"); got != "/a:/b" {
+		t.Errorf("mountOption lowerdir = %q, want /a:/b", got)
+	}
+	if got := mountOption(options, "metacopy"); got != "" {
+		t.Errorf("mountOption metacopy = %q, want empty", got)
+	}
+	if !hasMountOption(options, "userxattr") || hasMountOption(options, "ro") || hasMountOption(options, "upperdir") {
+		t.Errorf("hasMountOption does not match whole options of %q", options)
+	}
+}
+
+func TestIsReadOnlyBindMount(t *testing.T) {
+	dir := t.TempDir()
+	env, mounter := newTestEnvironment(t, dir, "")
+
+	err := env.run(context.Background(), func(op *operation) error {
+		if op.isReadOnlyBindMount(dir) {
+			t.Errorf("unmounted directory is reported as a read-only bind mount")
+		}
+
+		if err := op.bindMountReadOnly(dir, dir); err != nil {
+			return err
+		}
+		if !op.isReadOnlyBindMount(dir) {
+			t.Errorf("directory bound read-only onto itself is not reported as a read-only bind mount")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("bindMountReadOnly: %v", err)
+	}
+
+	if err := mounter.Unmount(dir, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// A read-only mount of another filesystem at the path is not a bind of it
+	tmp := filepath.Join(dir, "tmp")
+	if err := os.Mkdir(tmp, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := mounter.Mount("tmpfs", tmp, MountTypeTmpfs, syscall.MS_RDONLY, ""); err != nil {
+		t.Fatal(err)
+	}
+	err = env.run(context.Background(), func(op *operation) error {
+		if op.isReadOnlyBindMount(tmp) {
+			t.Errorf("read-only tmpfs is reported as a read-only bind mount")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
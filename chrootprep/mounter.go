@@ -0,0 +1,75 @@
+package chrootprep
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+const mountInfoPath = "/proc/self/mountinfo"
+
+// Mounter attaches and detaches the filesystems of environments
+type Mounter interface {
+	// Mount attaches a filesystem, taking the arguments of mount(2)
+	Mount(source string, target string, fstype string, flags uintptr, data string) error
+	// MountLoop attaches the filesystem in the image file source through a
+	// loop device, which Unmount releases. Only MS_RDONLY is used from flags.
+	MountLoop(ctx context.Context, source string, target string, fstype string, flags uintptr) error
+	// Unmount detaches the topmost filesystem at target, taking the flags of umount2(2)
+	Unmount(target string, flags int) error
+	// IsMountPoint checks if a filesystem is mounted at path
+	IsMountPoint(path string) bool
+	// MountInfo returns the mount table, later mounts stacked on earlier ones
+	MountInfo() ([]MountInfo, error)
+}
+
+// SystemMounter mounts filesystems in the mount namespace of the process,
+// and is used when Options.Mounter is nil
+type SystemMounter struct{}
+
+// Mount calls mount(2)
+func (SystemMounter) Mount(source string, target string, fstype string, flags uintptr, data string) error {
+	return syscall.Mount(source, target, fstype, flags, data)
+}
+
+// MountLoop runs mount(8), which sets up the loop device
+func (SystemMounter) MountLoop(ctx context.Context, source string, target string, fstype string, flags uintptr) error {
+	options := "loop"
+	if flags&syscall.MS_RDONLY != 0 {
+		options += ",ro"
+	}
+
+	cmd := exec.CommandContext(ctx, "mount", "-t", fstype, "-o", options, source, target)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		if output = bytes.TrimSpace(output); len(output) > 0 {
+			return fmt.Errorf("%w: %s", err, output)
+		}
+		return err
+	}
+	return nil
+}
+
+// Unmount calls umount2(2)
+func (SystemMounter) Unmount(target string, flags int) error {
+	return syscall.Unmount(target, flags)
+}
+
+// IsMountPoint asks mountpoint(1), which also recognizes bind mounts of a
+// directory onto itself
+func (SystemMounter) IsMountPoint(path string) bool {
+	return exec.Command("mountpoint", "-q", path).Run() == nil
+}
+
+// MountInfo parses /proc/self/mountinfo
+func (SystemMounter) MountInfo() ([]MountInfo, error) {
+	f, err := os.Open(mountInfoPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", mountInfoPath, err)
+	}
+	defer f.Close()
+
+	return parseMountInfo(f)
+}
@@ -0,0 +1,540 @@
+package chrootprep
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// OCI image layout file and directory names
+const (
+	ociLayoutFile = "oci-layout"
+	ociIndexFile  = "index.json"
+	ociBlobsDir   = "blobs"
+)
+
+// Whiteout markers used in OCI image layers
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
+// ociDescriptor references a blob in an OCI image layout
+type ociDescriptor struct {
+	MediaType string       `json:"mediaType"`
+	Digest    string       `json:"digest"`
+	Size      int64        `json:"size"`
+	Platform  *ociPlatform `json:"platform,omitempty"`
+}
+
+// ociPlatform describes the platform an image manifest was built for
+type ociPlatform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+}
+
+// ociIndex is an OCI image index (index.json or a nested index blob)
+type ociIndex struct {
+	MediaType string          `json:"mediaType"`
+	Manifests []ociDescriptor `json:"manifests"`
+}
+
+// ociManifest is an OCI image manifest
+type ociManifest struct {
+	MediaType string          `json:"mediaType"`
+	Layers    []ociDescriptor `json:"layers"`
+}
+
+// importOCILayout unpacks the layers of a local OCI image layout into chrootDir
+func (op *operation) importOCILayout(layoutDir string, chrootDir string) error {
+	// Validate image layout
+	if !fileExists(filepath.Join(layoutDir, ociLayoutFile)) {
+		return fmt.Errorf("%s is not an OCI image layout (missing %s)", layoutDir, ociLayoutFile)
+	}
+
+	manifest, err := resolveOCIManifest(layoutDir)
+	if err != nil {
+		return err
+	}
+
+	if len(manifest.Layers) == 0 {
+		return fmt.Errorf("image manifest in %s has no layers", layoutDir)
+	}
+
+	// A corrupt layer must not leave the layers below it applied
+	for _, layer := range manifest.Layers {
+		if err := op.canceled(); err != nil {
+			return err
+		}
+		if err := verifyOCIBlob(layoutDir, layer); err != nil {
+			return err
+		}
+	}
+
+	// Apply layers in order
+	for i, layer := range manifest.Layers {
+		if err := op.canceled(); err != nil {
+			return err
+		}
+
+		op.logf("Applying layer %d/%d: %s\n", i+1, len(manifest.Layers), layer.Digest)
+		if err := op.applyOCILayer(layoutDir, layer, chrootDir); err != nil {
+			return fmt.Errorf("failed to apply layer %s: %w", layer.Digest, err)
+		}
+	}
+
+	return nil
+}
+
+// resolveOCIManifest finds the image manifest for the host platform in an OCI image layout
+func resolveOCIManifest(layoutDir string) (*ociManifest, error) {
+	content, err := os.ReadFile(filepath.Join(layoutDir, ociIndexFile))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", ociIndexFile, err)
+	}
+
+	var index ociIndex
+	if err := json.Unmarshal(content, &index); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", ociIndexFile, err)
+	}
+
+	// Follow nested indexes until a manifest is found
+	for depth := 0; depth < 8; depth++ {
+		desc, err := selectOCIManifest(index.Manifests)
+		if err != nil {
+			return nil, err
+		}
+
+		content, err := readOCIBlob(layoutDir, desc)
+		if err != nil {
+			return nil, err
+		}
+
+		if isOCIIndexMediaType(desc.MediaType) {
+			index = ociIndex{}
+			if err := json.Unmarshal(content, &index); err != nil {
+				return nil, fmt.Errorf("failed to parse image index %s: %w", desc.Digest, err)
+			}
+			continue
+		}
+
+		var manifest ociManifest
+		if err := json.Unmarshal(content, &manifest); err != nil {
+			return nil, fmt.Errorf("failed to parse image manifest %s: %w", desc.Digest, err)
+		}
+		return &manifest, nil
+	}
+
+	return nil, fmt.Errorf("image index nesting is too deep in %s", layoutDir)
+}
+
+// selectOCIManifest picks the manifest matching the host platform from an index
+func selectOCIManifest(manifests []ociDescriptor) (ociDescriptor, error) {
+	if len(manifests) == 0 {
+		return ociDescriptor{}, fmt.Errorf("image index has no manifests")
+	}
+
+	// A single entry is used regardless of its platform
+	if len(manifests) == 1 {
+		return manifests[0], nil
+	}
+
+	for _, desc := range manifests {
+		if desc.Platform == nil {
+			continue
+		}
+		if desc.Platform.OS == "linux" && desc.Platform.Architecture == runtime.GOARCH {
+			return desc, nil
+		}
+	}
+
+	return ociDescriptor{}, fmt.Errorf("image index has no manifest for linux/%s", runtime.GOARCH)
+}
+
+// isOCIIndexMediaType checks if a media type refers to an image index
+func isOCIIndexMediaType(mediaType string) bool {
+	return mediaType == "application/vnd.oci.image.index.v1+json" ||
+		mediaType == "application/vnd.docker.distribution.manifest.list.v2+json"
+}
+
+// ociBlobPath returns the path of a blob in an OCI image layout
+func ociBlobPath(layoutDir string, digest string) (string, error) {
+	algorithm, encoded, ok := strings.Cut(digest, ":")
+	if !ok || algorithm != "sha256" || len(encoded) != sha256.Size*2 {
+		return "", fmt.Errorf("unsupported digest %q", digest)
+	}
+
+	if _, err := hex.DecodeString(encoded); err != nil {
+		return "", fmt.Errorf("invalid digest %q", digest)
+	}
+
+	return filepath.Join(layoutDir, ociBlobsDir, algorithm, encoded), nil
+}
+
+// readOCIBlob reads a small blob (index or manifest) and verifies its digest
+func readOCIBlob(layoutDir string, desc ociDescriptor) ([]byte, error) {
+	blobPath, err := ociBlobPath(layoutDir, desc.Digest)
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := os.ReadFile(blobPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read blob %s: %w", desc.Digest, err)
+	}
+
+	sum := sha256.Sum256(content)
+	if "sha256:"+hex.EncodeToString(sum[:]) != desc.Digest {
+		return nil, fmt.Errorf("blob %s does not match its digest", desc.Digest)
+	}
+
+	return content, nil
+}
+
+// verifyOCIBlob checks a blob of any size against its digest
+func verifyOCIBlob(layoutDir string, desc ociDescriptor) error {
+	blobPath, err := ociBlobPath(layoutDir, desc.Digest)
+	if err != nil {
+		return err
+	}
+
+	blob, err := os.Open(blobPath)
+	if err != nil {
+		return fmt.Errorf("failed to open blob %s: %w", desc.Digest, err)
+	}
+	defer blob.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, blob); err != nil {
+		return fmt.Errorf("failed to read blob %s: %w", desc.Digest, err)
+	}
+
+	if "sha256:"+hex.EncodeToString(hasher.Sum(nil)) != desc.Digest {
+		return fmt.Errorf("blob %s does not match its digest", desc.Digest)
+	}
+
+	return nil
+}
+
+// applyOCILayer decompresses a layer blob and applies it on top of chrootDir
+func (op *operation) applyOCILayer(layoutDir string, desc ociDescriptor, chrootDir string) error {
+	blobPath, err := ociBlobPath(layoutDir, desc.Digest)
+	if err != nil {
+		return err
+	}
+
+	blob, err := os.Open(blobPath)
+	if err != nil {
+		return fmt.Errorf("failed to open blob: %w", err)
+	}
+	defer blob.Close()
+
+	// Hash the compressed stream while it is being read
+	hasher := sha256.New()
+	compressed := io.TeeReader(blob, hasher)
+
+	var stream io.Reader
+	var decompressor *exec.Cmd
+	switch {
+	case strings.HasSuffix(desc.MediaType, "+gzip") || strings.HasSuffix(desc.MediaType, ".gzip"):
+		gz, err := gzip.NewReader(compressed)
+		if err != nil {
+			return fmt.Errorf("failed to read gzip stream: %w", err)
+		}
+		defer gz.Close()
+		stream = gz
+	case strings.HasSuffix(desc.MediaType, "+zstd"):
+		decompressor = op.command("zstd", "-d", "-c")
+		decompressor.Stdin = compressed
+		out, err := decompressor.StdoutPipe()
+		if err != nil {
+			return fmt.Errorf("failed to create zstd pipe: %w", err)
+		}
+		if err := decompressor.Start(); err != nil {
+			return fmt.Errorf("failed to start zstd: %w", err)
+		}
+		stream = out
+	case strings.HasSuffix(desc.MediaType, ".tar"):
+		stream = compressed
+	default:
+		return fmt.Errorf("unsupported layer media type %q", desc.MediaType)
+	}
+
+	if err := op.applyTarLayer(tar.NewReader(stream), chrootDir); err != nil {
+		if decompressor != nil {
+			decompressor.Process.Kill()
+			decompressor.Wait()
+		}
+		return err
+	}
+
+	// Drain any trailing data so that the digest covers the whole blob
+	if _, err := io.Copy(io.Discard, stream); err != nil {
+		return fmt.Errorf("failed to read layer: %w", err)
+	}
+
+	if decompressor != nil {
+		if err := decompressor.Wait(); err != nil {
+			return fmt.Errorf("zstd failed: %w", err)
+		}
+	}
+
+	if _, err := io.Copy(io.Discard, compressed); err != nil {
+		return fmt.Errorf("failed to read layer: %w", err)
+	}
+
+	if "sha256:"+hex.EncodeToString(hasher.Sum(nil)) != desc.Digest {
+		return fmt.Errorf("layer does not match its digest")
+	}
+
+	return nil
+}
+
+// applyTarLayer extracts a layer tar stream into root, turning whiteouts into deletions
+func (op *operation) applyTarLayer(tr *tar.Reader, root string) error {
+	// Paths created by this layer are never hidden by its own opaque markers
+	written := make(map[string]bool)
+
+	// Directory times are restored last, after their contents have been written
+	dirTimes := make(map[string]time.Time)
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read tar entry: %w", err)
+		}
+
+		rel := path.Clean("/" + hdr.Name)
+		if rel == "/" {
+			continue
+		}
+
+		dir, base := path.Split(rel)
+
+		if base == whiteoutOpaque {
+			if err := applyOpaqueWhiteout(root, dir, written); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if strings.HasPrefix(base, whiteoutPrefix) {
+			target, err := layerPath(root, path.Join(dir, base[len(whiteoutPrefix):]))
+			if err != nil {
+				return err
+			}
+			// A dangling symlink is removed as well, so the entry itself is checked
+			if _, err := os.Lstat(target); err == nil {
+				if err := os.RemoveAll(target); err != nil {
+					return fmt.Errorf("failed to apply whiteout for %s: %w", rel, err)
+				}
+			} else if !os.IsNotExist(err) {
+				return fmt.Errorf("failed to apply whiteout for %s: %w", rel, err)
+			}
+			continue
+		}
+
+		target, err := layerPath(root, rel)
+		if err != nil {
+			return err
+		}
+
+		if err := op.extractTarEntry(tr, hdr, root, target); err != nil {
+			return fmt.Errorf("failed to extract %s: %w", rel, err)
+		}
+
+		written[rel] = true
+		if hdr.Typeflag == tar.TypeDir {
+			dirTimes[target] = hdr.ModTime
+		}
+	}
+
+	for dir, mtime := range dirTimes {
+		if err := os.Chtimes(dir, mtime, mtime); err != nil {
+			return fmt.Errorf("failed to set times on %s: %w", dir, err)
+		}
+	}
+
+	return nil
+}
+
+// applyOpaqueWhiteout removes the lower-layer contents of an opaque directory
+func applyOpaqueWhiteout(root string, dir string, written map[string]bool) error {
+	target, err := layerPath(root, dir)
+	if err != nil {
+		return err
+	}
+
+	// Only real directories are emptied, never the target of a symlink
+	if info, err := os.Lstat(target); err != nil || !info.IsDir() {
+		return nil
+	}
+
+	entries, err := os.ReadDir(target)
+	if err != nil {
+		return fmt.Errorf("failed to read opaque directory %s: %w", dir, err)
+	}
+
+	for _, entry := range entries {
+		if written[path.Join(dir, entry.Name())] {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(target, entry.Name())); err != nil {
+			return fmt.Errorf("failed to apply opaque whiteout in %s: %w", dir, err)
+		}
+	}
+
+	return nil
+}
+
+// layerPath maps a cleaned layer path into root, refusing to follow symlinks in parent directories
+func layerPath(root string, rel string) (string, error) {
+	current := root
+	parts := strings.Split(strings.Trim(rel, "/"), "/")
+	for _, part := range parts[:len(parts)-1] {
+		current = filepath.Join(current, part)
+		info, err := os.Lstat(current)
+		if os.IsNotExist(err) {
+			break
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to stat %s: %w", current, err)
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return "", fmt.Errorf("layer path %s traverses symlink %s", rel, current)
+		}
+	}
+
+	return filepath.Join(root, rel), nil
+}
+
+// extractTarEntry creates a single tar entry at target and restores its metadata
+func (op *operation) extractTarEntry(tr *tar.Reader, hdr *tar.Header, root string, target string) error {
+	if err := ensureDir(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+
+	// Replace whatever was there before, except directories which are merged
+	if info, err := os.Lstat(target); err == nil {
+		if hdr.Typeflag != tar.TypeDir || !info.IsDir() {
+			if err := os.RemoveAll(target); err != nil {
+				return err
+			}
+		}
+	}
+
+	mode := uint32(hdr.Mode) & 07777
+
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if err := ensureDir(target, 0755); err != nil {
+			return err
+		}
+	case tar.TypeReg:
+		f, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(f, tr); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+	case tar.TypeSymlink:
+		return restoreSymlink(hdr, target)
+	case tar.TypeLink:
+		source, err := layerPath(root, path.Clean("/"+hdr.Linkname))
+		if err != nil {
+			return err
+		}
+		// Hardlinks share metadata with their source
+		return os.Link(source, target)
+	case tar.TypeChar:
+		if err := syscall.Mknod(target, syscall.S_IFCHR|mode, mkdev(hdr.Devmajor, hdr.Devminor)); err != nil {
+			return err
+		}
+	case tar.TypeBlock:
+		if err := syscall.Mknod(target, syscall.S_IFBLK|mode, mkdev(hdr.Devmajor, hdr.Devminor)); err != nil {
+			return err
+		}
+	case tar.TypeFifo:
+		if err := syscall.Mknod(target, syscall.S_IFIFO|mode, 0); err != nil {
+			return err
+		}
+	default:
+		op.logf("Warning: skipping unsupported tar entry type %q for %s\n", hdr.Typeflag, hdr.Name)
+		return nil
+	}
+
+	// Ownership first, since chown clears setuid and setgid bits
+	if err := os.Lchown(target, hdr.Uid, hdr.Gid); err != nil {
+		return err
+	}
+
+	if err := os.Chmod(target, tarFileMode(mode)); err != nil {
+		return err
+	}
+
+	for key, value := range hdr.PAXRecords {
+		name, ok := strings.CutPrefix(key, "SCHILY.xattr.")
+		if !ok {
+			continue
+		}
+		if err := syscall.Setxattr(target, name, []byte(value), 0); err != nil {
+			return fmt.Errorf("failed to set xattr %s: %w", name, err)
+		}
+	}
+
+	if hdr.Typeflag != tar.TypeDir {
+		if err := os.Chtimes(target, hdr.AccessTime, hdr.ModTime); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// restoreSymlink creates a symlink entry and sets its ownership
+func restoreSymlink(hdr *tar.Header, target string) error {
+	if err := os.Symlink(hdr.Linkname, target); err != nil {
+		return err
+	}
+	return os.Lchown(target, hdr.Uid, hdr.Gid)
+}
+
+// tarFileMode converts tar permission bits into an os.FileMode
+func tarFileMode(mode uint32) os.FileMode {
+	fileMode := os.FileMode(mode & 0777)
+	if mode&syscall.S_ISUID != 0 {
+		fileMode |= os.ModeSetuid
+	}
+	if mode&syscall.S_ISGID != 0 {
+		fileMode |= os.ModeSetgid
+	}
+	if mode&syscall.S_ISVTX != 0 {
+		fileMode |= os.ModeSticky
+	}
+	return fileMode
+}
+
+// mkdev encodes a device number from its major and minor parts
+func mkdev(major, minor int64) int {
+	return int((minor & 0xff) | ((major & 0xfff) << 8) | ((minor &^ 0xff) << 12) | ((major &^ 0xfff) << 32))
+}
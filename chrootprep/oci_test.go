@@ -0,0 +1,147 @@
+package chrootprep
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// tarLayer returns a layer tar stream of the headers, without contents
+func tarLayer(t *testing.T, headers ...*tar.Header) *tar.Reader {
+	t.Helper()
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, hdr := range headers {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return tar.NewReader(&buf)
+}
+
+// writeOCIBlob stores content as a blob of an OCI image layout and returns its descriptor
+func writeOCIBlob(t *testing.T, layoutDir string, mediaType string, content []byte) ociDescriptor {
+	t.Helper()
+
+	sum := sha256.Sum256(content)
+	desc := ociDescriptor{MediaType: mediaType, Digest: "sha256:" + hex.EncodeToString(sum[:]), Size: int64(len(content))}
+	blobPath, err := ociBlobPath(layoutDir, desc.Digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Dir(blobPath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(blobPath, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return desc
+}
+
+// newTestOCILayout creates an OCI image layout with an uncompressed layer per tar stream
+func newTestOCILayout(t *testing.T, layers ...*bytes.Buffer) string {
+	t.Helper()
+
+	layoutDir := t.TempDir()
+	var manifest ociManifest
+	for _, layer := range layers {
+		manifest.Layers = append(manifest.Layers, writeOCIBlob(t, layoutDir, "application/vnd.oci.image.layer.v1.tar", layer.Bytes()))
+	}
+
+	content, err := json.Marshal(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index := ociIndex{Manifests: []ociDescriptor{writeOCIBlob(t, layoutDir, "application/vnd.oci.image.manifest.v1+json", content)}}
+	if content, err = json.Marshal(index); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(layoutDir, ociIndexFile), content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(layoutDir, ociLayoutFile), []byte(`{"imageLayoutVersion": "1.0.0"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return layoutDir
+}
+
+func TestImportOCICorruptLayer(t *testing.T) {
+	ctx := context.Background()
+	var layers []*bytes.Buffer
+	for _, name := range []string{"etc/", "usr/"} {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		if err := tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeDir, Mode: 0755}); err != nil {
+			t.Fatal(err)
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		layers = append(layers, &buf)
+	}
+	layoutDir := newTestOCILayout(t, layers...)
+
+	// Corrupt the upper layer, the lower one is applied first
+	manifest, err := resolveOCIManifest(layoutDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blobPath, _ := ociBlobPath(layoutDir, manifest.Layers[1].Digest)
+	if err := os.WriteFile(blobPath, []byte("corrupt"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// An existing empty directory is kept, a created one is removed
+	existing := filepath.Join(t.TempDir(), "existing")
+	if err := os.Mkdir(existing, 0755); err != nil {
+		t.Fatal(err)
+	}
+	created := filepath.Join(t.TempDir(), "created")
+
+	for _, dir := range []string{existing, created} {
+		env, _ := newTestEnvironment(t, dir, "")
+		if err := env.ImportOCI(ctx, layoutDir); err == nil {
+			t.Fatalf("ImportOCI of a corrupt layer into %s succeeded", dir)
+		}
+	}
+	if entries, err := os.ReadDir(existing); err != nil || len(entries) != 0 {
+		t.Errorf("failed ImportOCI left %d entries in an existing directory: %v", len(entries), err)
+	}
+	if pathExists(created) {
+		t.Errorf("failed ImportOCI left the directory it created")
+	}
+}
+
+func TestApplyTarLayerWhiteoutDanglingSymlink(t *testing.T) {
+	root := t.TempDir()
+	env, _ := newTestEnvironment(t, newTestBase(t), "")
+	op := env.newOperation(context.Background())
+
+	lower := tarLayer(t,
+		&tar.Header{Name: "etc/", Typeflag: tar.TypeDir, Mode: 0755},
+		&tar.Header{Name: "etc/link", Typeflag: tar.TypeSymlink, Linkname: "/nonexistent", Mode: 0777},
+	)
+	if err := op.applyTarLayer(lower, root); err != nil {
+		t.Fatalf("applyTarLayer of the lower layer: %v", err)
+	}
+
+	upper := tarLayer(t, &tar.Header{Name: "etc/.wh.link", Typeflag: tar.TypeReg, Mode: 0644})
+	if err := op.applyTarLayer(upper, root); err != nil {
+		t.Fatalf("applyTarLayer of the upper layer: %v", err)
+	}
+
+	if _, err := os.Lstat(filepath.Join(root, "etc", "link")); !os.IsNotExist(err) {
+		t.Errorf("whited out dangling symlink is still there: %v", err)
+	}
+}
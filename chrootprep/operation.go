@@ -0,0 +1,121 @@
+package chrootprep
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+)
+
+// Logger receives the progress messages of environment operations.
+// *log.Logger satisfies it.
+type Logger interface {
+	Printf(format string, v ...any)
+}
+
+// discardLogger drops all messages, for environments created without a logger
+type discardLogger struct{}
+
+func (discardLogger) Printf(format string, v ...any) {}
+
+// operation is the state of one call of an environment method, passed to
+// the helpers doing its work
+type operation struct {
+	ctx context.Context
+	// logger receives progress messages and warnings
+	logger Logger
+	// mounter attaches and detaches filesystems
+	mounter Mounter
+	// overlayRoot is the storage root for new overlays, empty to keep them next to the base
+	overlayRoot string
+	// imageMountRoot is where image bases are mounted
+	imageMountRoot string
+	// preflightChecks are run before mounting overlays
+	preflightChecks []preflightCheck
+	// output receives the report of diff
+	output io.Writer
+}
+
+// newOperation returns the state of a call of an environment method
+func (e *Environment) newOperation(ctx context.Context) *operation {
+	return &operation{
+		ctx:             ctx,
+		logger:          e.logger,
+		mounter:         e.mounter,
+		overlayRoot:     e.overlayRoot,
+		imageMountRoot:  e.imageMountRoot,
+		preflightChecks: e.preflightChecks,
+		output:          io.Discard,
+	}
+}
+
+// run runs fn as an operation of the environment, unless ctx is already done
+func (e *Environment) run(ctx context.Context, fn func(op *operation) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return fn(e.newOperation(ctx))
+}
+
+// logf sends a progress message to the logger of the operation
+func (op *operation) logf(format string, v ...any) {
+	op.logger.Printf(format, v...)
+}
+
+// command prepares an external command that is killed when the operation
+// is canceled
+func (op *operation) command(name string, args ...string) *exec.Cmd {
+	return exec.CommandContext(op.ctx, name, args...)
+}
+
+// runCommand runs an external command, sending what it prints to the
+// logger, except for output it already has a writer for
+func (op *operation) runCommand(cmd *exec.Cmd) error {
+	output := &lineLogger{op: op}
+	if cmd.Stdout == nil {
+		cmd.Stdout = output
+	}
+	if cmd.Stderr == nil {
+		cmd.Stderr = output
+	}
+
+	err := cmd.Run()
+	output.flush()
+	return err
+}
+
+// lineLogger sends each line written to it to the logger of an operation
+type lineLogger struct {
+	op      *operation
+	pending []byte
+}
+
+func (l *lineLogger) Write(p []byte) (int, error) {
+	l.pending = append(l.pending, p...)
+	for {
+		i := bytes.IndexByte(l.pending, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		l.op.logf("%s\n", l.pending[:i])
+		l.pending = l.pending[i+1:]
+	}
+}
+
+// flush sends the last line when it is not terminated
+func (l *lineLogger) flush() {
+	if len(l.pending) > 0 {
+		l.op.logf("%s\n", l.pending)
+		l.pending = nil
+	}
+}
+
+// canceled returns the error of the operation's context once it is
+// canceled, for long walks to stop early
+func (op *operation) canceled() error {
+	if err := op.ctx.Err(); err != nil {
+		return fmt.Errorf("operation canceled: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,717 @@
+package chrootprep
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// getOverlayPaths returns the paths for upper, work, and merged directories
+func (op *operation) getOverlayPaths(chrootDir string, overlayName string) (upper, work, merged string) {
+	overlayDir := op.getOverlayDir(chrootDir, overlayName)
+	if overlayDir == "" {
+		return "", "", ""
+	}
+	upper = filepath.Join(overlayDir, UpperDir)
+	work = filepath.Join(overlayDir, WorkDir)
+	merged = filepath.Join(overlayDir, MergedDir)
+	return upper, work, merged
+}
+
+// setupOverlayDirs creates the necessary directories for overlay
+func (op *operation) setupOverlayDirs(chrootDir string, overlayName string) (upper, work, merged string, err error) {
+	overlayDir := op.getOverlayDir(chrootDir, overlayName)
+	if overlayDir == "" {
+		return "", "", "", ErrInvalidName
+	}
+
+	// Create overlay base directory
+	if err = ensureDir(overlayDir, 0755); err != nil {
+		return "", "", "", fmt.Errorf("failed to create overlay directory: %w", err)
+	}
+
+	// Get paths
+	upper, work, merged = op.getOverlayPaths(chrootDir, overlayName)
+
+	// Create subdirectories
+	if err = ensureDir(upper, 0755); err != nil {
+		return "", "", "", fmt.Errorf("failed to create upper directory: %w", err)
+	}
+
+	if err = ensureDir(work, 0755); err != nil {
+		return "", "", "", fmt.Errorf("failed to create work directory: %w", err)
+	}
+
+	if err = ensureDir(merged, 0755); err != nil {
+		return "", "", "", fmt.Errorf("failed to create merged directory: %w", err)
+	}
+
+	return upper, work, merged, nil
+}
+
+// setupOverlayTmpfs mounts a tmpfs at the overlay directory
+func (op *operation) setupOverlayTmpfs(chrootDir string, overlayName string, size string) error {
+	overlayDir := op.getOverlayDir(chrootDir, overlayName)
+	if overlayDir == "" {
+		return ErrInvalidName
+	}
+
+	// A tmpfs would hide the contents of an existing disk-backed overlay
+	if dirExists(filepath.Join(overlayDir, UpperDir)) && !op.isMounted(overlayDir) {
+		return fmt.Errorf("overlay '%s' %w on disk at %s", overlayName, ErrExist, overlayDir)
+	}
+
+	if err := ensureDir(overlayDir, 0755); err != nil {
+		return fmt.Errorf("failed to create overlay directory: %w", err)
+	}
+
+	// Reuse a tmpfs left mounted by an earlier partial setup
+	if op.isTmpfsOverlay(chrootDir, overlayName) {
+		return nil
+	}
+
+	return op.mountTmpfs(overlayDir, size)
+}
+
+// protectBase bind mounts the base read-only over itself, so that it cannot
+// be modified underneath its overlays. It reports whether it added the bind,
+// which is already there while other overlays protect the base.
+func (op *operation) protectBase(chrootDir string) (bool, error) {
+	if op.isReadOnlyBindMount(chrootDir) {
+		return false, nil
+	}
+
+	// The bind would hide filesystems mounted by a normal setup
+	if err := op.validateNotMounted(chrootDir); err != nil {
+		return false, fmt.Errorf("cannot protect base: %w", err)
+	}
+
+	if err := op.bindMountReadOnly(chrootDir, chrootDir); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// releaseBaseProtection removes the read-only bind over the base once no
+// overlays and no read-only setup of the base are using it anymore
+func (op *operation) releaseBaseProtection(chrootDir string) error {
+	if !op.isReadOnlyBindMount(chrootDir) {
+		return nil
+	}
+
+	if len(op.findMountedOverlays(chrootDir)) > 0 || op.validateNotMounted(chrootDir) != nil {
+		return nil
+	}
+
+	if err := op.umountPath(chrootDir); err != nil {
+		return fmt.Errorf("failed to remove base protection: %w", err)
+	}
+
+	op.logf("Base %s is writable again\n", chrootDir)
+	return nil
+}
+
+// isTmpfsOverlay checks if an overlay is backed by a mounted tmpfs
+func (op *operation) isTmpfsOverlay(chrootDir string, overlayName string) bool {
+	overlayDir := op.getOverlayDir(chrootDir, overlayName)
+	if overlayDir == "" {
+		return false
+	}
+
+	mount := op.findMount(overlayDir)
+	return mount != nil && mount.FSType == MountTypeTmpfs
+}
+
+// overlaySetupOptions returns the setup options matching how an overlay is currently set up
+func (op *operation) overlaySetupOptions(chrootDir string, overlayName string) SetupOptions {
+	var opts SetupOptions
+
+	// Metadata of a tmpfs-backed overlay is lost together with the tmpfs
+	meta, err := op.readOverlayMetadata(chrootDir, overlayName)
+	if err == nil && meta != nil {
+		if len(meta.Parents) > 0 {
+			opts.From = meta.Parents[0]
+		}
+		opts.MountOptions = meta.Options
+		opts.Backend = meta.Backend
+	}
+
+	mount := op.findMount(op.getOverlayDir(chrootDir, overlayName))
+	if mount != nil && mount.FSType == MountTypeTmpfs {
+		opts.Tmpfs = true
+		opts.TmpfsSize = mountOption(mount.SuperOptions, "size")
+	}
+
+	if op.isOverlaySetup(chrootDir, overlayName) {
+		_, _, merged := op.getOverlayPaths(chrootDir, overlayName)
+		opts.ReadOnly = op.isReadOnlyMount(merged)
+		// Only overlayfs layers depend on the base staying unchanged
+		opts.ProtectBase = backendName(meta) == BackendOverlay && op.isReadOnlyBindMount(chrootDir)
+	}
+
+	return opts
+}
+
+// getOverlayLowerDirs returns the lowerdir stack of an overlay: the upper
+// directories of its parents, nearest first, followed by the base
+func (op *operation) getOverlayLowerDirs(chrootDir string, meta *OverlayMetadata) string {
+	var lowers []string
+	if meta != nil {
+		for _, parent := range meta.Parents {
+			upper, _, _ := op.getOverlayPaths(chrootDir, parent)
+			lowers = append(lowers, upper)
+		}
+	}
+	lowers = append(lowers, op.getBaseRoot(chrootDir))
+	return strings.Join(lowers, ":")
+}
+
+// umountOverlayStorage unmounts the tmpfs backing an overlay directory, if any
+func (op *operation) umountOverlayStorage(chrootDir string, overlayName string) error {
+	if !op.isTmpfsOverlay(chrootDir, overlayName) {
+		return nil
+	}
+
+	return op.umountPath(op.getOverlayDir(chrootDir, overlayName))
+}
+
+// deleteOverlayDir deletes an overlay directory. Ephemeral overlays have
+// nothing on disk, so only their empty mountpoint is removed.
+func (op *operation) deleteOverlayDir(overlayDir string, ephemeral bool) error {
+	var err error
+	if ephemeral {
+		op.logf("Overlay at %s was tmpfs-backed, nothing on disk to delete\n", overlayDir)
+		err = os.Remove(overlayDir)
+	} else {
+		err = os.RemoveAll(overlayDir)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Drop the per-base directory under the overlay root once it is empty
+	parentDir := filepath.Dir(overlayDir)
+	if op.overlayRoot != "" && filepath.Dir(parentDir) == op.overlayRoot {
+		os.Remove(parentDir)
+	}
+
+	return nil
+}
+
+// mountOverlay mounts the overlay filesystem for the chroot
+func (op *operation) mountOverlay(chrootDir string, overlayName string) error {
+	// Check if already mounted
+	if op.isOverlaySetup(chrootDir, overlayName) {
+		return fmt.Errorf("overlay '%s' is %w for %s", overlayName, ErrAlreadySetUp, chrootDir)
+	}
+
+	// Setup directories if they don't exist
+	upper, work, merged, err := op.setupOverlayDirs(chrootDir, overlayName)
+	if err != nil {
+		return err
+	}
+
+	// Validate before mounting
+	err = op.validateOverlayRequirements(chrootDir, overlayName)
+	if err != nil {
+		return err
+	}
+
+	meta, err := op.readOverlayMetadata(chrootDir, overlayName)
+	if err != nil {
+		return err
+	}
+
+	var options []string
+	if meta != nil {
+		options = meta.Options
+	}
+
+	// Mount overlay filesystem
+	err = op.mountOverlayFS(op.getOverlayLowerDirs(chrootDir, meta), upper, work, merged, options)
+	if err != nil {
+		return fmt.Errorf("failed to mount overlay: %w", err)
+	}
+
+	return nil
+}
+
+// umountOverlay unmounts the overlay filesystem
+func (op *operation) umountOverlay(chrootDir string, overlayName string) error {
+	_, _, merged := op.getOverlayPaths(chrootDir, overlayName)
+
+	if merged == "" {
+		return fmt.Errorf("invalid overlay configuration")
+	}
+
+	if !op.isMounted(merged) {
+		op.logf("Overlay '%s' at %s is not mounted\n", overlayName, merged)
+		return nil
+	}
+
+	// Unmount merged directory
+	err := op.umountPath(merged)
+	if err != nil {
+		return fmt.Errorf("failed to unmount overlay: %w", err)
+	}
+
+	return nil
+}
+
+// cleanupOverlayDirs removes overlay directories (optional, for complete cleanup)
+func (op *operation) cleanupOverlayDirs(chrootDir string, overlayName string) error {
+	overlayDir := op.getOverlayDir(chrootDir, overlayName)
+	if overlayDir == "" {
+		return ErrInvalidName
+	}
+
+	// First ensure nothing is mounted
+	if !op.isOverlaySetup(chrootDir, overlayName) {
+		// Nothing mounted, can safely remove
+		return removeIfExists(overlayDir)
+	}
+
+	// Need to unmount first
+	err := op.umountOverlay(chrootDir, overlayName)
+	if err != nil {
+		return fmt.Errorf("failed to unmount before cleanup: %w", err)
+	}
+
+	// Remove the entire overlay directory
+	err = removeIfExists(overlayDir)
+	if err != nil {
+		return fmt.Errorf("failed to remove overlay directory: %w", err)
+	}
+
+	return nil
+}
+
+// validateOverlayRequirements validates that overlay can be set up
+func (op *operation) validateOverlayRequirements(chrootDir string, overlayName string) error {
+	// Check if base chroot directory exists
+	if !dirExists(op.getBaseRoot(chrootDir)) {
+		return fmt.Errorf("base directory %s %w", op.getBaseRoot(chrootDir), ErrNotExist)
+	}
+
+	// Get overlay paths
+	upper, work, _ := op.getOverlayPaths(chrootDir, overlayName)
+
+	// Ensure upper and work directories exist
+	if !dirExists(upper) {
+		return fmt.Errorf("upper directory %s %w", upper, ErrNotExist)
+	}
+
+	if !dirExists(work) {
+		return fmt.Errorf("work directory %s %w", work, ErrNotExist)
+	}
+
+	meta, err := op.readOverlayMetadata(chrootDir, overlayName)
+	if err != nil {
+		return err
+	}
+
+	var options []string
+	if meta != nil {
+		options = meta.Options
+	}
+
+	// Check the kernel and filesystems before overlayfs fails with a bare EINVAL
+	return op.preflightOverlay(chrootDir, overlayName, options)
+}
+
+// cloneOverlay copies the changes of an overlay into a newly created overlay
+func (op *operation) cloneOverlay(chrootDir string, overlayName string, newName string) error {
+	// Validate source overlay
+	if err := op.validateOverlayStructure(chrootDir, overlayName); err != nil {
+		return err
+	}
+
+	// Refuse to overwrite an existing overlay
+	newDir := op.getOverlayDir(chrootDir, newName)
+	if pathExists(newDir) {
+		return fmt.Errorf("overlay '%s' %w at %s", newName, ErrExist, newDir)
+	}
+
+	if op.isOverlaySetup(chrootDir, overlayName) {
+		op.logf("Warning: overlay '%s' is mounted, changes made during the copy may be missed\n", overlayName)
+	}
+
+	meta, err := op.readOverlayMetadata(chrootDir, overlayName)
+	if err != nil {
+		return err
+	}
+
+	backend := op.getOverlayBackend(chrootDir, overlayName)
+	if err := backend.Clone(chrootDir, overlayName, newName); err != nil {
+		backend.Delete(chrootDir, newName)
+		removeIfExists(newDir)
+		return err
+	}
+
+	// The clone is stacked on the same parents as its source
+	if meta != nil {
+		newMeta := *meta
+		newMeta.Name = newName
+		newMeta.Created = time.Now().UTC()
+		if err := op.writeOverlayMetadata(chrootDir, &newMeta); err != nil {
+			backend.Delete(chrootDir, newName)
+			removeIfExists(newDir)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// resetOverlay discards all changes in an overlay, keeping its directory layout
+func (op *operation) resetOverlay(chrootDir string, overlayName string) error {
+	if err := op.validateOverlayStructure(chrootDir, overlayName); err != nil {
+		return err
+	}
+
+	// Stacked overlays would see their lower layer change underneath them
+	dependents, err := op.findDependentOverlays(chrootDir, overlayName)
+	if err != nil {
+		return err
+	}
+	if len(dependents) > 0 {
+		return fmt.Errorf("overlay '%s' is %w by %s and cannot be reset", overlayName, ErrInUse, strings.Join(dependents, ", "))
+	}
+
+	// Check before cleanup, which unmounts the tmpfs
+	ephemeral := op.isTmpfsOverlay(chrootDir, overlayName)
+
+	// The layers must not be modified while mounted
+	if op.isOverlaySetup(chrootDir, overlayName) {
+		if err := op.cleanupOverlayEnvironment(chrootDir, overlayName); err != nil {
+			return fmt.Errorf("failed to cleanup before reset: %w", err)
+		}
+	} else if ephemeral {
+		// A tmpfs left mounted without its overlay still holds the changes
+		if err := op.umountOverlayStorage(chrootDir, overlayName); err != nil {
+			return fmt.Errorf("failed to unmount overlay storage: %w", err)
+		}
+	}
+
+	// A tmpfs-backed overlay lost its contents when it was unmounted
+	if ephemeral {
+		return nil
+	}
+
+	meta, err := op.loadOverlayMetadata(chrootDir, overlayName)
+	if err != nil {
+		return err
+	}
+
+	if err := op.getOverlayBackend(chrootDir, overlayName).Reset(chrootDir, meta); err != nil {
+		return err
+	}
+
+	return op.writeOverlayMetadata(chrootDir, meta)
+}
+
+// overlayOptionSupport lists the extra overlayfs mount options that can be
+// requested, with their allowed values and the first kernel supporting them.
+// Options without values are flags.
+var overlayOptionSupport = map[string]struct {
+	values []string
+	major  int
+	minor  int
+}{
+	"redirect_dir": {[]string{"on", "off", "follow", "nofollow"}, 4, 10},
+	"index":        {[]string{"on", "off"}, 4, 13},
+	"nfs_export":   {[]string{"on", "off"}, 4, 16},
+	"xino":         {[]string{"on", "off", "auto"}, 4, 17},
+	"metacopy":     {[]string{"on", "off"}, 4, 19},
+	"volatile":     {nil, 5, 10},
+	"userxattr":    {nil, 5, 11},
+}
+
+// validateOverlayOptions checks extra overlayfs mount options against the running kernel
+func validateOverlayOptions(options []string) error {
+	if len(options) == 0 {
+		return nil
+	}
+
+	major, minor, err := kernelVersion()
+	if err != nil {
+		return err
+	}
+
+	values := make(map[string]string)
+	for _, option := range options {
+		key, value, hasValue := strings.Cut(option, "=")
+
+		support, ok := overlayOptionSupport[key]
+		if !ok {
+			return fmt.Errorf("unsupported overlay mount option '%s'", option)
+		}
+
+		if hasValue != (support.values != nil) || (hasValue && !slices.Contains(support.values, value)) {
+			if support.values == nil {
+				return fmt.Errorf("overlay mount option '%s' does not take a value", key)
+			}
+			return fmt.Errorf("overlay mount option '%s' must be one of %s", key, strings.Join(support.values, ", "))
+		}
+
+		if major < support.major || (major == support.major && minor < support.minor) {
+			return fmt.Errorf("overlay mount option '%s' requires Linux %d.%d or later (running %d.%d)", key, support.major, support.minor, major, minor)
+		}
+
+		values[key] = value
+	}
+
+	// The kernel rejects these combinations at mount time with a less helpful error
+	if values["nfs_export"] == "on" && values["index"] != "on" {
+		return fmt.Errorf("overlay mount option 'nfs_export=on' requires 'index=on'")
+	}
+
+	if values["nfs_export"] == "on" && values["metacopy"] == "on" {
+		return fmt.Errorf("overlay mount options 'nfs_export=on' and 'metacopy=on' cannot be combined")
+	}
+
+	return nil
+}
+
+// kernelVersion returns the major and minor version of the running kernel
+func kernelVersion() (major, minor int, err error) {
+	var uname syscall.Utsname
+	if err := syscall.Uname(&uname); err != nil {
+		return 0, 0, fmt.Errorf("failed to get kernel version: %w", err)
+	}
+
+	var release strings.Builder
+	for _, c := range uname.Release {
+		if c == 0 {
+			break
+		}
+		release.WriteByte(byte(c))
+	}
+
+	if _, err := fmt.Sscanf(release.String(), "%d.%d", &major, &minor); err != nil {
+		return 0, 0, fmt.Errorf("failed to parse kernel version %q: %w", release.String(), err)
+	}
+
+	return major, minor, nil
+}
+
+// materializeOverlay copies the merged view of an overlay into a new standalone directory
+func (op *operation) materializeOverlay(chrootDir string, overlayName string, dest string) error {
+	if pathExists(dest) {
+		return fmt.Errorf("%s %w", dest, ErrExist)
+	}
+
+	meta, err := op.loadOverlayMetadata(chrootDir, overlayName)
+	if err != nil {
+		return err
+	}
+
+	if op.isOverlaySetup(chrootDir, overlayName) {
+		op.logf("Warning: overlay '%s' is mounted, changes made during the copy may be missed\n", overlayName)
+	}
+
+	return op.getOverlayBackend(chrootDir, overlayName).Materialize(chrootDir, meta, dest)
+}
+
+// overlayBackend stores the changes of an environment in the upper
+// directory of an overlayfs mount on top of its parents and the base
+type overlayBackend struct {
+	*operation
+}
+
+// Validate checks that the upper, work and merged directories exist
+func (b overlayBackend) Validate(chrootDir string, overlayName string) error {
+	upper, work, merged := b.getOverlayPaths(chrootDir, overlayName)
+	for _, dir := range []string{upper, work, merged} {
+		if !dirExists(dir) {
+			return fmt.Errorf("required overlay directory %s does not exist", dir)
+		}
+	}
+	return nil
+}
+
+// Prepare checks the base and options, and creates the overlay directories
+// on disk or on a tmpfs
+func (b overlayBackend) Prepare(chrootDir string, meta *OverlayMetadata, opts SetupOptions) error {
+	// Check the recorded options against what the running kernel supports
+	if err := validateOverlayOptions(meta.Options); err != nil {
+		return err
+	}
+
+	// Overlayfs behaviour is undefined when the lower layer has changed
+	if err := b.checkBaseDrift(chrootDir, meta, opts.AcceptDrift); err != nil {
+		return err
+	}
+
+	for _, parent := range meta.Parents {
+		if _, ok := b.getOverlayBackend(chrootDir, parent).(overlayBackend); !ok {
+			return fmt.Errorf("parent overlay '%s' does not use the overlay backend", parent)
+		}
+		if err := b.attachOverlayStorage(chrootDir, parent); err != nil {
+			return err
+		}
+		if b.isOverlaySetup(chrootDir, parent) {
+			b.logf("Warning: parent overlay '%s' is mounted, changes made in it are not visible consistently in '%s'\n", parent, meta.Name)
+		}
+	}
+
+	// Keep the base read-only while the overlay is mounted
+	protected := false
+	if opts.ProtectBase {
+		var err error
+		if protected, err = b.protectBase(chrootDir); err != nil {
+			return err
+		}
+	}
+
+	// Back the overlay with a tmpfs before creating upper and work
+	if opts.Tmpfs {
+		if err := b.setupOverlayTmpfs(chrootDir, meta.Name, opts.TmpfsSize); err != nil {
+			if protected {
+				b.releaseBaseProtection(chrootDir)
+			}
+			return err
+		}
+	}
+
+	// Setup overlay directories
+	if _, _, _, err := b.setupOverlayDirs(chrootDir, meta.Name); err != nil {
+		b.umountOverlayStorage(chrootDir, meta.Name)
+		if protected {
+			b.releaseBaseProtection(chrootDir)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// Mount mounts the overlay filesystem on top of its parents and the base
+func (b overlayBackend) Mount(chrootDir string, meta *OverlayMetadata, readOnly bool) error {
+	if err := b.validateOverlayRequirements(chrootDir, meta.Name); err != nil {
+		return err
+	}
+
+	var err error
+	upper, work, merged := b.getOverlayPaths(chrootDir, meta.Name)
+	lower := b.getOverlayLowerDirs(chrootDir, meta)
+	if readOnly {
+		// The overlay's own changes become the topmost lower layer
+		err = b.mountOverlayFSReadOnly(upper+":"+lower, merged, meta.Options)
+	} else {
+		err = b.mountOverlayFS(lower, upper, work, merged, meta.Options)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to mount overlay: %w", err)
+	}
+
+	return nil
+}
+
+// Unmount unmounts the overlay filesystem
+func (b overlayBackend) Unmount(chrootDir string, overlayName string) error {
+	return b.umountOverlay(chrootDir, overlayName)
+}
+
+// Release unmounts the tmpfs backing an ephemeral overlay, discarding its
+// contents, and detaches the storage images of the overlay and its parents
+// that no mounted overlay uses anymore
+func (b overlayBackend) Release(chrootDir string, overlayName string) error {
+	// The parents are recorded on the storage image of the overlay itself
+	meta, _ := b.readOverlayMetadata(chrootDir, overlayName)
+
+	if err := b.umountOverlayStorage(chrootDir, overlayName); err != nil {
+		return err
+	}
+
+	if err := b.releaseOverlayStorage(chrootDir, overlayName); err != nil {
+		return err
+	}
+
+	if meta != nil {
+		for _, parent := range meta.Parents {
+			if err := b.releaseOverlayStorage(chrootDir, parent); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// IsMounted checks if the overlay filesystem is mounted at merged
+func (b overlayBackend) IsMounted(chrootDir string, overlayName string) bool {
+	_, _, merged := b.getOverlayPaths(chrootDir, overlayName)
+	return b.isMounted(merged)
+}
+
+// Delete detaches and deletes the storage image of a size-limited overlay
+func (b overlayBackend) Delete(chrootDir string, overlayName string) error {
+	return b.detachOverlayStorage(b.getOverlayDir(chrootDir, overlayName))
+}
+
+// Clone copies the upper layer, including whiteouts and overlay xattrs
+func (b overlayBackend) Clone(chrootDir string, overlayName string, newName string) error {
+	newUpper, _, _, err := b.setupOverlayDirs(chrootDir, newName)
+	if err != nil {
+		return err
+	}
+
+	upper, _, _ := b.getOverlayPaths(chrootDir, overlayName)
+	return b.copyTree(upper, newUpper)
+}
+
+// Reset empties the upper and work directories
+func (b overlayBackend) Reset(chrootDir string, meta *OverlayMetadata) error {
+	upper, work, _ := b.getOverlayPaths(chrootDir, meta.Name)
+
+	if err := emptyDir(upper); err != nil {
+		return fmt.Errorf("failed to empty upper directory: %w", err)
+	}
+
+	if err := emptyDir(work); err != nil {
+		return fmt.Errorf("failed to empty work directory: %w", err)
+	}
+
+	// A pristine overlay starts over from the current base
+	var err error
+	meta.BaseFingerprint, err = b.baseFingerprint(chrootDir)
+	return err
+}
+
+// Layers returns the upper directory, the upper directories of the parents and the base
+func (b overlayBackend) Layers(chrootDir string, meta *OverlayMetadata) []string {
+	upper, _, _ := b.getOverlayPaths(chrootDir, meta.Name)
+	return append([]string{upper}, strings.Split(b.getOverlayLowerDirs(chrootDir, meta), ":")...)
+}
+
+// Materialize copies the merged view from a temporary read-only mount of the
+// overlay's layers, using reflinks where the filesystem supports them
+func (b overlayBackend) Materialize(chrootDir string, meta *OverlayMetadata, dest string) error {
+	view, err := os.MkdirTemp("", "chroot-prep-view-")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary mountpoint: %w", err)
+	}
+	defer os.Remove(view)
+
+	upper, _, _ := b.getOverlayPaths(chrootDir, meta.Name)
+	lower := upper + ":" + b.getOverlayLowerDirs(chrootDir, meta)
+	if err := b.mountOverlayFSReadOnly(lower, view, meta.Options); err != nil {
+		return err
+	}
+	defer b.umountPath(view)
+
+	if err := ensureDir(dest, 0755); err != nil {
+		return err
+	}
+
+	if err := b.copyTree(view, dest); err != nil {
+		removeIfExists(dest)
+		return err
+	}
+
+	return nil
+}
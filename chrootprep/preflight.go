@@ -0,0 +1,310 @@
+package chrootprep
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// Filesystem types reported by statfs that overlayfs cares about
+const (
+	nfsSuperMagic     = 0x6969
+	smbSuperMagic     = 0x517b
+	cifsSuperMagic    = 0xff534d42
+	smb2SuperMagic    = 0xfe534d42
+	overlaySuperMagic = 0x794c7630
+	xfsSuperMagic     = 0x58465342
+)
+
+// Preflight failures, wrapped in a PreflightError saying how to fix them
+var (
+	ErrOverlayUnavailable = errors.New("overlayfs is not supported by the running kernel")
+	ErrUnsupportedUpper   = errors.New("filesystem cannot hold an overlay upper layer")
+	ErrNoDType            = errors.New("filesystem does not report file types (d_type)")
+	ErrNestedLayers       = errors.New("base and overlay directories overlap")
+	ErrSplitUpperWork     = errors.New("upper and work directories are on different filesystems")
+)
+
+// PreflightError is a failed preflight check
+type PreflightError struct {
+	Check string // name of the failed check
+	Path  string // path the check failed on, if any
+	Err   error  // one of the Err* preflight failures
+	Fix   string // what to do about it
+}
+
+func (e *PreflightError) Error() string {
+	msg := e.Err.Error()
+	if e.Path != "" {
+		msg = e.Path + ": " + msg
+	}
+	if e.Fix != "" {
+		msg += " (" + e.Fix + ")"
+	}
+	return msg
+}
+
+func (e *PreflightError) Unwrap() error {
+	return e.Err
+}
+
+// preflightCheck is a named check of what an overlay needs from the host
+type preflightCheck struct {
+	name string
+	run  func(op *operation, chrootDir string, overlayName string, options []string) error
+}
+
+// preflightChecks lists the checks run before mounting an overlay, in order
+var preflightChecks = []preflightCheck{
+	{"overlayfs", (*operation).checkOverlayFSAvailable},
+	{"layout", (*operation).checkLayerLayout},
+	{"upper filesystem", (*operation).checkUpperFilesystem},
+	{"d_type", (*operation).checkDType},
+	{"upper and work", (*operation).checkUpperWork},
+}
+
+// preflightOverlay runs all preflight checks and returns the first failure
+func (op *operation) preflightOverlay(chrootDir string, overlayName string, options []string) error {
+	for _, check := range op.preflightChecks {
+		if err := check.run(op, chrootDir, overlayName, options); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// overlayLocation returns the overlay directory, or its closest existing
+// ancestor when the overlay has not been created yet
+func (op *operation) overlayLocation(chrootDir string, overlayName string) string {
+	dir := op.getOverlayDir(chrootDir, overlayName)
+	for !dirExists(dir) && filepath.Dir(dir) != dir {
+		dir = filepath.Dir(dir)
+	}
+	return dir
+}
+
+// isWithin checks if a path is a directory or lies below it
+func isWithin(path string, dir string) bool {
+	return path == dir || strings.HasPrefix(path, dir+string(filepath.Separator))
+}
+
+// kernelFilesystems returns the filesystem types listed in /proc/filesystems
+func kernelFilesystems() ([]string, error) {
+	file, err := os.Open("/proc/filesystems")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read supported filesystems: %w", err)
+	}
+	defer file.Close()
+
+	var types []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 0 {
+			types = append(types, fields[len(fields)-1])
+		}
+	}
+	return types, scanner.Err()
+}
+
+// checkOverlayFSAvailable checks that the kernel supports overlayfs, loading
+// the module if it is not yet loaded
+func (op *operation) checkOverlayFSAvailable(chrootDir string, overlayName string, options []string) error {
+	types, err := kernelFilesystems()
+	if err != nil {
+		return err
+	}
+
+	if !slices.Contains(types, "overlay") {
+		op.command("modprobe", "-q", "overlay").Run()
+		if types, err = kernelFilesystems(); err != nil {
+			return err
+		}
+	}
+
+	if !slices.Contains(types, "overlay") {
+		return &PreflightError{
+			Check: "overlayfs",
+			Err:   ErrOverlayUnavailable,
+			Fix:   "load the overlay module, or set up with -backend copy",
+		}
+	}
+	return nil
+}
+
+// checkLayerLayout checks that the base and the overlay directory do not
+// contain each other, which would make a layer part of another
+func (op *operation) checkLayerLayout(chrootDir string, overlayName string, options []string) error {
+	base, err := filepath.EvalSymlinks(op.getBaseRoot(chrootDir))
+	if err != nil {
+		return fmt.Errorf("failed to resolve base directory: %w", err)
+	}
+
+	// The overlay directory may not exist yet, resolve what does
+	overlayDir := op.getOverlayDir(chrootDir, overlayName)
+	location := op.overlayLocation(chrootDir, overlayName)
+	resolved, err := filepath.EvalSymlinks(location)
+	if err != nil {
+		return fmt.Errorf("failed to resolve overlay directory: %w", err)
+	}
+	overlayDir = resolved + strings.TrimPrefix(overlayDir, location)
+
+	switch {
+	case isWithin(overlayDir, base):
+		return &PreflightError{
+			Check: "layout",
+			Path:  overlayDir,
+			Err:   ErrNestedLayers,
+			Fix:   "store overlays outside the base with -overlay-root",
+		}
+	case isWithin(base, overlayDir):
+		return &PreflightError{
+			Check: "layout",
+			Path:  base,
+			Err:   ErrNestedLayers,
+			Fix:   "move the base out of the overlay directory",
+		}
+	}
+	return nil
+}
+
+// checkUpperFilesystem checks that the filesystem holding the overlay can
+// serve as an upper layer
+func (op *operation) checkUpperFilesystem(chrootDir string, overlayName string, options []string) error {
+	location := op.overlayLocation(chrootDir, overlayName)
+
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(location, &st); err != nil {
+		return fmt.Errorf("failed to stat %s: %w", location, err)
+	}
+
+	switch uint32(st.Type) {
+	case nfsSuperMagic, smbSuperMagic, cifsSuperMagic, smb2SuperMagic:
+		return &PreflightError{
+			Check: "upper filesystem",
+			Path:  location,
+			Err:   ErrUnsupportedUpper,
+			Fix:   "store overlays on a local filesystem with -overlay-root, or use -tmpfs",
+		}
+
+	case overlaySuperMagic:
+		// Nested overlays keep their own metadata in user xattrs only
+		if !slices.Contains(options, "userxattr") {
+			return &PreflightError{
+				Check: "upper filesystem",
+				Path:  location,
+				Err:   ErrUnsupportedUpper,
+				Fix:   "add -options userxattr, or store overlays outside the overlay with -overlay-root",
+			}
+		}
+	}
+	return nil
+}
+
+// checkDType checks that an XFS filesystem holding the overlay was created
+// with ftype=1, without which overlayfs cannot find whiteouts
+func (op *operation) checkDType(chrootDir string, overlayName string, options []string) error {
+	location := op.overlayLocation(chrootDir, overlayName)
+
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(location, &st); err != nil {
+		return fmt.Errorf("failed to stat %s: %w", location, err)
+	}
+	if st.Type != xfsSuperMagic {
+		return nil
+	}
+
+	supported, err := supportsDType(location)
+	if err != nil {
+		return err
+	}
+	if !supported {
+		return &PreflightError{
+			Check: "d_type",
+			Path:  location,
+			Err:   ErrNoDType,
+			Fix:   "store overlays on a filesystem with d_type, such as XFS formatted with ftype=1, with -overlay-root",
+		}
+	}
+	return nil
+}
+
+// supportsDType checks if directory entries read from a directory carry
+// their file type, using a throwaway file
+func supportsDType(dir string) (bool, error) {
+	probe, err := os.MkdirTemp(dir, ".chroot-prep-dtype-")
+	if err != nil {
+		return false, fmt.Errorf("failed to create d_type probe: %w", err)
+	}
+	defer os.RemoveAll(probe)
+
+	if err := os.WriteFile(filepath.Join(probe, "file"), nil, 0600); err != nil {
+		return false, fmt.Errorf("failed to create d_type probe: %w", err)
+	}
+
+	fd, err := syscall.Open(probe, syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		return false, fmt.Errorf("failed to open d_type probe: %w", err)
+	}
+	defer syscall.Close(fd)
+
+	buf := make([]byte, 4096)
+	n, err := syscall.ReadDirent(fd, buf)
+	if err != nil {
+		return false, fmt.Errorf("failed to read d_type probe: %w", err)
+	}
+
+	// Walk the linux_dirent64 records for the probe file
+	for offset := 0; offset < n; {
+		dirent := (*syscall.Dirent)(unsafe.Pointer(&buf[offset]))
+		name := unsafe.Slice((*byte)(unsafe.Pointer(&dirent.Name[0])), len(dirent.Name))
+		if end := slices.Index(name, 0); end >= 0 && string(name[:end]) == "file" {
+			return dirent.Type != syscall.DT_UNKNOWN, nil
+		}
+		offset += int(dirent.Reclen)
+	}
+
+	return false, fmt.Errorf("d_type probe file not found in %s", probe)
+}
+
+// checkUpperWork checks that existing upper and work directories share a
+// filesystem, as overlayfs moves files between them
+func (op *operation) checkUpperWork(chrootDir string, overlayName string, options []string) error {
+	upper, work, _ := op.getOverlayPaths(chrootDir, overlayName)
+	if !dirExists(upper) || !dirExists(work) {
+		return nil
+	}
+
+	var statUpper, statWork syscall.Stat_t
+	if err := syscall.Stat(upper, &statUpper); err != nil {
+		return fmt.Errorf("failed to stat upper directory: %w", err)
+	}
+	if err := syscall.Stat(work, &statWork); err != nil {
+		return fmt.Errorf("failed to stat work directory: %w", err)
+	}
+
+	if statUpper.Dev != statWork.Dev {
+		return &PreflightError{
+			Check: "upper and work",
+			Path:  op.getOverlayDir(chrootDir, overlayName),
+			Err:   ErrSplitUpperWork,
+			Fix:   "remove the overlay and set it up again",
+		}
+	}
+	return nil
+}
+
+// runPreflightChecks runs all preflight checks and returns the result of each
+func (op *operation) runPreflightChecks(chrootDir string, overlayName string, options []string) []CheckResult {
+	results := make([]CheckResult, 0, len(preflightChecks))
+	for _, check := range op.preflightChecks {
+		results = append(results, CheckResult{Name: check.name, Err: check.run(op, chrootDir, overlayName, options)})
+	}
+	return results
+}
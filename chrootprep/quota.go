@@ -0,0 +1,295 @@
+package chrootprep
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// QuotaImageSuffix is appended to the overlay directory to name the image
+// holding a size-limited overlay
+const QuotaImageSuffix = ".img"
+
+// getQuotaImagePath returns the path of an overlay's storage image
+func (op *operation) getQuotaImagePath(chrootDir string, overlayName string) string {
+	return op.getOverlayDir(chrootDir, overlayName) + QuotaImageSuffix
+}
+
+// isQuotaOverlay checks if an overlay keeps its layers on a storage image
+func (op *operation) isQuotaOverlay(chrootDir string, overlayName string) bool {
+	return fileExists(op.getQuotaImagePath(chrootDir, overlayName))
+}
+
+// parseSize parses a size such as 512M or 10G into bytes
+func parseSize(size string) (int64, error) {
+	units := map[string]int64{
+		"K": 1 << 10,
+		"M": 1 << 20,
+		"G": 1 << 30,
+		"T": 1 << 40,
+	}
+
+	number, multiplier := size, int64(1)
+	if n := len(size); n > 0 {
+		if unit, ok := units[strings.ToUpper(size[n-1:])]; ok {
+			number, multiplier = size[:n-1], unit
+		}
+	}
+
+	value, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || value <= 0 {
+		return 0, fmt.Errorf("invalid size '%s' (e.g. 512M, 10G)", size)
+	}
+
+	return value * multiplier, nil
+}
+
+// formatSize formats a byte count for display
+func formatSize(bytes int64) string {
+	const units = "KMGT"
+
+	if bytes < 1024 {
+		return fmt.Sprintf("%dB", bytes)
+	}
+
+	value := float64(bytes)
+	unit := -1
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+	return fmt.Sprintf("%.1f%c", value, units[unit])
+}
+
+// setupQuotaImage creates the ext4 image of a new size-limited overlay, or
+// checks that an existing one has the requested size
+func (op *operation) setupQuotaImage(chrootDir string, overlayName string, quota string) error {
+	size, err := parseSize(quota)
+	if err != nil {
+		return err
+	}
+
+	image := op.getQuotaImagePath(chrootDir, overlayName)
+	if info, err := os.Stat(image); err == nil {
+		if info.Size() != size {
+			return fmt.Errorf("overlay '%s' %w with a quota of %s", overlayName, ErrExist, formatSize(info.Size()))
+		}
+		return nil
+	}
+
+	// The layers of an existing overlay cannot be moved onto an image
+	overlayDir := op.getOverlayDir(chrootDir, overlayName)
+	if dirExists(filepath.Join(overlayDir, UpperDir)) {
+		return fmt.Errorf("overlay '%s' %w without a quota at %s", overlayName, ErrExist, overlayDir)
+	}
+
+	if err := ensureDir(filepath.Dir(image), 0755); err != nil {
+		return err
+	}
+
+	// A sparse file only takes disk space as the overlay fills up
+	file, err := os.OpenFile(image, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create storage image: %w", err)
+	}
+	err = file.Truncate(size)
+	file.Close()
+	if err != nil {
+		os.Remove(image)
+		return fmt.Errorf("failed to size storage image: %w", err)
+	}
+
+	// No blocks reserved for root, the whole quota is usable in the chroot
+	cmd := op.command("mkfs.ext4", "-q", "-F", "-m", "0", image)
+	if err := op.runCommand(cmd); err != nil {
+		os.Remove(image)
+		return fmt.Errorf("failed to format storage image: %w", err)
+	}
+
+	return nil
+}
+
+// setupQuotaOverlayEnvironment creates the storage image of a new
+// size-limited overlay and sets the overlay up on it. The image and the
+// overlay directory are removed again when the setup fails.
+func (op *operation) setupQuotaOverlayEnvironment(chrootDir string, overlayName string, opts SetupOptions) error {
+	if err := op.setupQuotaImage(chrootDir, overlayName, opts.Quota); err != nil {
+		return err
+	}
+
+	if err := op.setupOverlayEnvironment(chrootDir, overlayName, opts); err != nil {
+		overlayDir := op.getOverlayDir(chrootDir, overlayName)
+		if err := op.detachOverlayStorage(overlayDir); err != nil {
+			op.logf("Warning: failed to remove storage image: %v\n", err)
+		} else {
+			// Only the mountpoint of the image is left
+			os.Remove(overlayDir)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// attachOverlayStorage loop-mounts the storage image of a size-limited
+// overlay at its overlay directory. The image stays attached while the
+// overlay or one stacked on it is mounted, and is attached again by the
+// commands reading the overlay.
+func (op *operation) attachOverlayStorage(chrootDir string, overlayName string) error {
+	if !op.isQuotaOverlay(chrootDir, overlayName) {
+		return nil
+	}
+
+	overlayDir := op.getOverlayDir(chrootDir, overlayName)
+	if op.isMounted(overlayDir) {
+		return nil
+	}
+
+	return op.mountStorageImage(overlayDir)
+}
+
+// mountStorageImage loop-mounts the storage image of an overlay directory on it
+func (op *operation) mountStorageImage(overlayDir string) error {
+	if err := ensureDir(overlayDir, 0755); err != nil {
+		return fmt.Errorf("failed to create overlay directory: %w", err)
+	}
+
+	if err := op.mounter.MountLoop(op.ctx, overlayDir+QuotaImageSuffix, overlayDir, ImageTypeExt4, 0); err != nil {
+		return fmt.Errorf("failed to mount storage image at %s: %w", overlayDir, err)
+	}
+
+	return nil
+}
+
+// withOverlayStorage runs fn with the layers of an overlay directory reachable,
+// attaching a detached storage image for the duration of the call
+func (op *operation) withOverlayStorage(overlayDir string, fn func() error) error {
+	if !fileExists(overlayDir+QuotaImageSuffix) || op.isMounted(overlayDir) {
+		return fn()
+	}
+
+	if err := op.mountStorageImage(overlayDir); err != nil {
+		return err
+	}
+
+	err := fn()
+	if uerr := op.umountPath(overlayDir); uerr != nil && err == nil {
+		err = fmt.Errorf("failed to detach storage image from %s: %w", overlayDir, uerr)
+	}
+	return err
+}
+
+// releaseOverlayStorage detaches the storage image of a size-limited
+// overlay, unless the overlay or one stacked on it is mounted
+func (op *operation) releaseOverlayStorage(chrootDir string, overlayName string) error {
+	overlayDir := op.getOverlayDir(chrootDir, overlayName)
+	if !op.isQuotaOverlay(chrootDir, overlayName) || !op.isMounted(overlayDir) {
+		return nil
+	}
+
+	if op.isOverlaySetup(chrootDir, overlayName) {
+		return nil
+	}
+
+	for _, name := range op.findMountedOverlays(chrootDir) {
+		meta, err := op.readOverlayMetadata(chrootDir, name)
+		if err == nil && meta != nil && slices.Contains(meta.Parents, overlayName) {
+			return nil
+		}
+	}
+
+	if err := op.umountPath(overlayDir); err != nil {
+		return fmt.Errorf("failed to detach storage image of overlay '%s': %w", overlayName, err)
+	}
+	return nil
+}
+
+// detachOverlayStorage unmounts and deletes the storage image of a size-limited overlay
+func (op *operation) detachOverlayStorage(overlayDir string) error {
+	image := overlayDir + QuotaImageSuffix
+	if !fileExists(image) {
+		return nil
+	}
+
+	if op.isMounted(overlayDir) {
+		if err := op.umountPath(overlayDir); err != nil {
+			return err
+		}
+	}
+
+	return os.Remove(image)
+}
+
+// overlayUsage returns the space used by an overlay, and its size limit
+// when it is backed by a tmpfs or a storage image (0 when unlimited)
+func (op *operation) overlayUsage(chrootDir string, overlayName string) (used int64, limit int64, err error) {
+	overlayDir := op.getOverlayDir(chrootDir, overlayName)
+
+	// Overlays keep their changes in upper and work, copies their whole tree
+	// in merged, without the host filesystems mounted in it
+	dirs := []string{UpperDir, WorkDir}
+	skip := make(map[string]bool)
+	switch op.getOverlayBackend(chrootDir, overlayName).(type) {
+	case btrfsBackend:
+		// Snapshots share their extents with the base, so exclusive usage needs qgroups
+		return 0, 0, fmt.Errorf("usage of btrfs snapshots is not tracked")
+	case copyBackend:
+		dirs = []string{MergedDir}
+		for dir := range essentialMountpoints {
+			skip[filepath.Join(overlayDir, MergedDir, dir)] = true
+		}
+	}
+
+	if op.isTmpfsOverlay(chrootDir, overlayName) || (op.isQuotaOverlay(chrootDir, overlayName) && op.isMounted(overlayDir)) {
+		var st syscall.Statfs_t
+		if err := syscall.Statfs(overlayDir, &st); err != nil {
+			return 0, 0, fmt.Errorf("failed to stat %s: %w", overlayDir, err)
+		}
+		return int64(st.Blocks-st.Bfree) * st.Bsize, int64(st.Blocks) * st.Bsize, nil
+	}
+
+	// A detached image is measured by the space allocated to the sparse file
+	if op.isQuotaOverlay(chrootDir, overlayName) {
+		var st syscall.Stat_t
+		image := op.getQuotaImagePath(chrootDir, overlayName)
+		if err := syscall.Stat(image, &st); err != nil {
+			return 0, 0, fmt.Errorf("failed to stat %s: %w", image, err)
+		}
+		return st.Blocks * 512, st.Size, nil
+	}
+
+	// Disk-backed layers are measured like du, counting hardlinks once
+	seen := make(map[uint64]bool)
+	for _, dir := range dirs {
+		err := filepath.WalkDir(filepath.Join(overlayDir, dir), func(path string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+
+			if skip[path] {
+				return filepath.SkipDir
+			}
+
+			var st syscall.Stat_t
+			if err := syscall.Lstat(path, &st); err != nil {
+				return err
+			}
+
+			if !seen[st.Ino] {
+				seen[st.Ino] = true
+				used += st.Blocks * 512
+			}
+			return nil
+		})
+		if err != nil && !os.IsNotExist(err) {
+			return 0, 0, fmt.Errorf("failed to measure overlay '%s': %w", overlayName, err)
+		}
+	}
+
+	return used, 0, nil
+}
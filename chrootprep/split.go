@@ -0,0 +1,362 @@
+package chrootprep
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// splitStats counts the changes found while splitting a tree
+type splitStats struct {
+	added   int
+	changed int
+	removed int
+}
+
+// splitTree writes the differences between a modified tree and the base
+// into an overlay upper directory, so that the overlay's merged view
+// matches the modified tree
+func (op *operation) splitTree(chrootDir string, modifiedDir string, upper string) (*splitStats, error) {
+	stats := &splitStats{}
+	links := make(map[fileID]string)
+
+	// Added and changed entries
+	err := filepath.WalkDir(modifiedDir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if err := op.canceled(); err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(modifiedDir, path)
+		if err != nil || rel == "." {
+			return err
+		}
+
+		var modified, base syscall.Stat_t
+		if err := syscall.Lstat(path, &modified); err != nil {
+			return fmt.Errorf("failed to stat %s: %w", path, err)
+		}
+
+		baseErr := syscall.Lstat(filepath.Join(chrootDir, rel), &base)
+		switch {
+		case baseErr != nil:
+			// New entry, copied as a whole
+			stats.added++
+			if err := op.copyUpperEntry(modifiedDir, upper, rel, links); err != nil {
+				return err
+			}
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+
+		case modified.Mode&syscall.S_IFMT != base.Mode&syscall.S_IFMT:
+			// Type changed; the new entry hides whatever the base has there
+			stats.changed++
+			if err := op.copyUpperEntry(modifiedDir, upper, rel, links); err != nil {
+				return err
+			}
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+
+		case entry.IsDir():
+			// Directories are merged, and only copied up when their attributes differ
+			if modified.Mode != base.Mode || modified.Uid != base.Uid || modified.Gid != base.Gid {
+				stats.changed++
+				if err := ensureUpperDirs(modifiedDir, upper, rel); err != nil {
+					return err
+				}
+			}
+
+		default:
+			changed, err := isChangedEntry(path, filepath.Join(chrootDir, rel), &modified, &base)
+			if err != nil {
+				return fmt.Errorf("failed to compare %s: %w", rel, err)
+			}
+			if changed {
+				stats.changed++
+				if err := op.copyUpperEntry(modifiedDir, upper, rel, links); err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to compare %s: %w", modifiedDir, err)
+	}
+
+	// Removed entries become whiteouts
+	err = filepath.WalkDir(chrootDir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if err := op.canceled(); err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(chrootDir, path)
+		if err != nil || rel == "." {
+			return err
+		}
+
+		info, err := os.Lstat(filepath.Join(modifiedDir, rel))
+		if err == nil {
+			// Replaced directories were copied as a whole and hide the base
+			if entry.IsDir() && !info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		stats.removed++
+		if err := ensureUpperDirs(modifiedDir, upper, filepath.Dir(rel)); err != nil {
+			return err
+		}
+		if err := syscall.Mknod(filepath.Join(upper, rel), syscall.S_IFCHR, 0); err != nil {
+			return fmt.Errorf("failed to create whiteout for %s: %w", rel, err)
+		}
+
+		if entry.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to compare %s: %w", chrootDir, err)
+	}
+
+	return stats, nil
+}
+
+// isChangedEntry checks if a non-directory entry differs between two trees.
+// Regular files of the same size and modification time are compared byte
+// by byte, unless they are the same file.
+func isChangedEntry(modifiedPath, basePath string, modified, base *syscall.Stat_t) (bool, error) {
+	if modified.Mode != base.Mode || modified.Uid != base.Uid || modified.Gid != base.Gid {
+		return true, nil
+	}
+
+	switch modified.Mode & syscall.S_IFMT {
+	case syscall.S_IFLNK:
+		modifiedTarget, err1 := os.Readlink(modifiedPath)
+		baseTarget, err2 := os.Readlink(basePath)
+		return err1 != nil || err2 != nil || modifiedTarget != baseTarget, nil
+	case syscall.S_IFCHR, syscall.S_IFBLK:
+		return modified.Rdev != base.Rdev, nil
+	case syscall.S_IFREG:
+		if modified.Size != base.Size || modified.Mtim != base.Mtim {
+			return true, nil
+		}
+		if modified.Dev == base.Dev && modified.Ino == base.Ino {
+			return false, nil
+		}
+		same, err := sameContent(modifiedPath, basePath)
+		return !same, err
+	}
+
+	return false, nil
+}
+
+// sameContent checks if two files hold the same bytes
+func sameContent(path1, path2 string) (bool, error) {
+	file1, err := os.Open(path1)
+	if err != nil {
+		return false, err
+	}
+	defer file1.Close()
+
+	file2, err := os.Open(path2)
+	if err != nil {
+		return false, err
+	}
+	defer file2.Close()
+
+	buf1, buf2 := make([]byte, 64*1024), make([]byte, 64*1024)
+	for {
+		n1, err1 := io.ReadFull(file1, buf1)
+		n2, err2 := io.ReadFull(file2, buf2)
+		if !bytes.Equal(buf1[:n1], buf2[:n2]) {
+			return false, nil
+		}
+
+		// Both ends are reached together for files of the same bytes
+		done1 := err1 == io.EOF || err1 == io.ErrUnexpectedEOF
+		done2 := err2 == io.EOF || err2 == io.ErrUnexpectedEOF
+		switch {
+		case err1 != nil && !done1:
+			return false, fmt.Errorf("failed to read %s: %w", path1, err1)
+		case err2 != nil && !done2:
+			return false, fmt.Errorf("failed to read %s: %w", path2, err2)
+		case done1 || done2:
+			return done1 && done2, nil
+		}
+	}
+}
+
+// fileID identifies a file by its device and inode numbers
+type fileID struct {
+	dev uint64
+	ino uint64
+}
+
+// copyUpperEntry copies an entry (recursively for directories) from the
+// modified tree into upper, creating its parent directories first. Files
+// hardlinked in the modified tree stay hardlinked in upper, links records
+// the first copy of each.
+func (op *operation) copyUpperEntry(modifiedDir, upper, rel string, links map[fileID]string) error {
+	if err := ensureUpperDirs(modifiedDir, upper, filepath.Dir(rel)); err != nil {
+		return err
+	}
+
+	cmd := op.command("cp", "--archive", "--reflink=auto", filepath.Join(modifiedDir, rel), filepath.Join(upper, rel))
+	if err := op.runCommand(cmd); err != nil {
+		return fmt.Errorf("failed to copy %s: %w", rel, err)
+	}
+
+	return linkUpperCopies(modifiedDir, upper, rel, links)
+}
+
+// linkUpperCopies replaces the copies of hardlinked files made by a cp with
+// links to the copies made by earlier ones, which cp cannot know about
+func linkUpperCopies(modifiedDir, upper, rel string, links map[fileID]string) error {
+	return filepath.WalkDir(filepath.Join(modifiedDir, rel), func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+
+		var st syscall.Stat_t
+		if err := syscall.Lstat(path, &st); err != nil {
+			return fmt.Errorf("failed to stat %s: %w", path, err)
+		}
+		if st.Nlink < 2 {
+			return nil
+		}
+
+		linkRel, err := filepath.Rel(modifiedDir, path)
+		if err != nil {
+			return err
+		}
+
+		id := fileID{dev: uint64(st.Dev), ino: st.Ino}
+		first, ok := links[id]
+		if !ok {
+			links[id] = linkRel
+			return nil
+		}
+
+		// Links within a copied directory are kept by cp itself
+		target, firstCopy := filepath.Join(upper, linkRel), filepath.Join(upper, first)
+		targetInfo, err1 := os.Lstat(target)
+		firstInfo, err2 := os.Lstat(firstCopy)
+		if err1 == nil && err2 == nil && os.SameFile(targetInfo, firstInfo) {
+			return nil
+		}
+
+		if err := os.Remove(target); err != nil {
+			return fmt.Errorf("failed to replace %s: %w", target, err)
+		}
+		if err := os.Link(firstCopy, target); err != nil {
+			return fmt.Errorf("failed to link %s to %s: %w", target, firstCopy, err)
+		}
+		return nil
+	})
+}
+
+// ensureUpperDirs creates the directories leading to rel in upper, with the
+// ownership and permissions they have in the modified tree
+func ensureUpperDirs(modifiedDir, upper, rel string) error {
+	if rel == "." || dirExists(filepath.Join(upper, rel)) {
+		return nil
+	}
+
+	if err := ensureUpperDirs(modifiedDir, upper, filepath.Dir(rel)); err != nil {
+		return err
+	}
+
+	info, err := os.Lstat(filepath.Join(modifiedDir, rel))
+	if err != nil {
+		return fmt.Errorf("failed to stat %s: %w", rel, err)
+	}
+
+	target := filepath.Join(upper, rel)
+	if err := os.Mkdir(target, 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %w", target, err)
+	}
+
+	st := info.Sys().(*syscall.Stat_t)
+	if err := os.Lchown(target, int(st.Uid), int(st.Gid)); err != nil {
+		return fmt.Errorf("failed to set ownership of %s: %w", target, err)
+	}
+
+	if err := os.Chmod(target, info.Mode()); err != nil {
+		return fmt.Errorf("failed to set permissions of %s: %w", target, err)
+	}
+
+	return nil
+}
+
+// splitEnvironment creates a new overlay on the base holding the differences
+// between the base and a modified full tree
+func (op *operation) splitEnvironment(chrootDir string, modifiedDir string, overlayName string) error {
+	if err := validateChrootStructure(op.getBaseRoot(chrootDir)); err != nil {
+		return err
+	}
+
+	if err := validateChrootStructure(modifiedDir); err != nil {
+		return err
+	}
+
+	// Contents of /proc, /dev and /sys must not end up in the overlay
+	for _, dir := range []string{op.getBaseRoot(chrootDir), modifiedDir} {
+		if err := op.validateNotMounted(dir); err != nil {
+			return err
+		}
+	}
+
+	overlayDir := op.getOverlayDir(chrootDir, overlayName)
+	if pathExists(overlayDir) {
+		return fmt.Errorf("overlay '%s' %w at %s", overlayName, ErrExist, overlayDir)
+	}
+
+	meta, err := op.newOverlayMetadata(chrootDir, overlayName, "", nil)
+	if err != nil {
+		return err
+	}
+
+	if err := op.checkBaseDrift(chrootDir, meta, false); err != nil {
+		return err
+	}
+
+	upper, _, _, err := op.setupOverlayDirs(chrootDir, overlayName)
+	if err != nil {
+		return err
+	}
+
+	stats, err := op.splitTree(op.getBaseRoot(chrootDir), modifiedDir, upper)
+	if err != nil {
+		removeIfExists(overlayDir)
+		return err
+	}
+
+	if err := op.writeOverlayMetadata(chrootDir, meta); err != nil {
+		removeIfExists(overlayDir)
+		return err
+	}
+
+	op.logf("Added: %d, changed: %d, removed: %d\n", stats.added, stats.changed, stats.removed)
+	return nil
+}
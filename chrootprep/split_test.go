@@ -0,0 +1,82 @@
+package chrootprep
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestModifiedTree returns a copy of base to be modified
+func newTestModifiedTree(t *testing.T, base string) string {
+	t.Helper()
+
+	modified := filepath.Join(t.TempDir(), "modified")
+	if out, err := exec.Command("cp", "--archive", base, modified).CombinedOutput(); err != nil {
+		t.Fatalf("failed to copy base: %v: %s", err, out)
+	}
+	return modified
+}
+
+func TestSplitSameSizeAndTime(t *testing.T) {
+	ctx := context.Background()
+	base := newTestBase(t)
+	modified := newTestModifiedTree(t, base)
+	env, _ := newTestEnvironment(t, base, "split")
+	upper, _, _ := env.newOperation(ctx).getOverlayPaths(base, "split")
+
+	// A change that keeps the size and the modification time of the file
+	hostname := filepath.Join(modified, "etc", "hostname")
+	info, err := os.Stat(hostname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(hostname, []byte("edit\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(hostname, time.Time{}, info.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := env.Split(ctx, modified); err != nil {
+		t.Fatalf("Split: %v", err)
+	}
+	if content, err := os.ReadFile(filepath.Join(upper, "etc", "hostname")); err != nil || string(content) != "edit\n" {
+		t.Errorf("upper hostname = %q, %v, want \"edit\\n\"", content, err)
+	}
+}
+
+func TestSplitHardlinks(t *testing.T) {
+	ctx := context.Background()
+	base := newTestBase(t)
+	modified := newTestModifiedTree(t, base)
+	env, _ := newTestEnvironment(t, base, "split")
+	upper, _, _ := env.newOperation(ctx).getOverlayPaths(base, "split")
+
+	// Names of one file in an existing directory and in a new one
+	tool := filepath.Join(modified, "bin", "tool")
+	if err := os.WriteFile(tool, []byte("tool\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(modified, "sbin"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(tool, filepath.Join(modified, "sbin", "tool")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := env.Split(ctx, modified); err != nil {
+		t.Fatalf("Split: %v", err)
+	}
+
+	info1, err1 := os.Lstat(filepath.Join(upper, "bin", "tool"))
+	info2, err2 := os.Lstat(filepath.Join(upper, "sbin", "tool"))
+	if err1 != nil || err2 != nil {
+		t.Fatalf("hardlinked files are missing from upper: %v, %v", err1, err2)
+	}
+	if !os.SameFile(info1, info2) {
+		t.Errorf("hardlinked files were split into separate copies")
+	}
+}
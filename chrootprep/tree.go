@@ -0,0 +1,87 @@
+package chrootprep
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+// treeBackend holds what the backends keeping a whole root filesystem at the
+// merged directory have in common. Such a tree is used in place, and needs
+// no mount besides the essential filesystems.
+type treeBackend struct {
+	*operation
+}
+
+// treeSource returns the tree a new environment is created from: the
+// parent's tree when stacked, the base otherwise
+func (op *operation) treeSource(chrootDir string, meta *OverlayMetadata) (string, error) {
+	if len(meta.Parents) == 0 {
+		return op.getBaseRoot(chrootDir), nil
+	}
+
+	parent := meta.Parents[0]
+	parentMeta, err := op.readOverlayMetadata(chrootDir, parent)
+	if err != nil {
+		return "", err
+	}
+
+	if name := backendName(parentMeta); name != backendName(meta) {
+		return "", fmt.Errorf("parent overlay '%s' uses the %s backend, not %s", parent, name, backendName(meta))
+	}
+
+	_, _, merged := op.getOverlayPaths(chrootDir, parent)
+	return merged, nil
+}
+
+// validateTreeOptions rejects the setup options that only apply to overlayfs
+func validateTreeOptions(meta *OverlayMetadata, opts SetupOptions) error {
+	name := backendName(meta)
+	switch {
+	case opts.Tmpfs:
+		return fmt.Errorf("tmpfs storage is not available with the %s backend", name)
+	case opts.Quota != "":
+		return fmt.Errorf("quotas are not available with the %s backend", name)
+	case len(meta.Options) > 0:
+		return fmt.Errorf("overlayfs mount options are not available with the %s backend", name)
+	case opts.ProtectBase:
+		return fmt.Errorf("an environment of the %s backend does not depend on its base, there is nothing to protect", name)
+	}
+	return nil
+}
+
+// Mount binds the tree read-only over itself for a read-only setup.
+// Otherwise the tree is used in place.
+func (b treeBackend) Mount(chrootDir string, meta *OverlayMetadata, readOnly bool) error {
+	if !readOnly {
+		return nil
+	}
+
+	_, _, merged := b.getOverlayPaths(chrootDir, meta.Name)
+	return b.bindMountReadOnly(merged, merged)
+}
+
+// Unmount removes the read-only bind of a read-only setup
+func (b treeBackend) Unmount(chrootDir string, overlayName string) error {
+	_, _, merged := b.getOverlayPaths(chrootDir, overlayName)
+	if !b.isMounted(merged) {
+		return nil
+	}
+	return b.umountPath(merged)
+}
+
+// Release does nothing, trees hold no resources while unmounted
+func (treeBackend) Release(chrootDir string, overlayName string) error {
+	return nil
+}
+
+// IsMounted checks for the read-only bind or the essential filesystems in the tree
+func (b treeBackend) IsMounted(chrootDir string, overlayName string) bool {
+	_, _, merged := b.getOverlayPaths(chrootDir, overlayName)
+	return b.isMounted(merged) || b.isMounted(filepath.Join(merged, "proc"))
+}
+
+// Layers returns the tree, which holds the whole root filesystem
+func (b treeBackend) Layers(chrootDir string, meta *OverlayMetadata) []string {
+	_, _, merged := b.getOverlayPaths(chrootDir, meta.Name)
+	return []string{merged}
+}
@@ -0,0 +1,55 @@
+package chrootprep
+
+// EnvironmentType represents the type of chroot environment
+type EnvironmentType int
+
+const (
+	// NormalEnvironment is a standard chroot environment
+	NormalEnvironment EnvironmentType = iota
+	// OverlayEnvironment is a chroot environment using OverlayFS
+	OverlayEnvironment
+)
+
+// Directory name constants for OverlayFS
+const (
+	OverlaySuffix = ".overlay"
+	UpperDir      = "upper"
+	WorkDir       = "work"
+	MergedDir     = "merged"
+	MetadataFile  = "overlay.json"
+)
+
+// Mount type constants
+const (
+	MountTypeProc    = "proc"
+	MountTypeSysfs   = "sysfs"
+	MountTypeOverlay = "overlay"
+	MountTypeTmpfs   = "tmpfs"
+)
+
+// SetupOptions holds optional settings for Setup
+type SetupOptions struct {
+	// Tmpfs mounts a tmpfs at the overlay directory so that upper and work never touch disk
+	Tmpfs bool
+	// TmpfsSize limits the size of the tmpfs (e.g. "2G"), empty for the kernel default
+	TmpfsSize string
+	// Quota limits the size of a new overlay by keeping its layers on an ext4 image (e.g. "10G")
+	Quota string
+	// Backend selects the layering backend of a new overlay (overlay, btrfs or copy)
+	Backend string
+	// AllowCopy falls back to the copy backend when overlayfs cannot be mounted
+	AllowCopy bool
+	// From stacks a new overlay on top of another overlay of the same base
+	From string
+	// MountOptions are extra overlayfs mount options (e.g. "metacopy=on")
+	MountOptions []string
+	// ReadOnly mounts an immutable view of the base or overlay for inspection
+	ReadOnly bool
+	// ProtectBase bind mounts the base read-only over itself while overlays are mounted
+	ProtectBase bool
+	// AcceptDrift mounts an overlay even if its base has changed since it was created
+	AcceptDrift bool
+	// Ensure completes an existing setup by mounting only what is missing,
+	// instead of failing because it is already set up
+	Ensure bool
+}
@@ -1,4 +1,4 @@
-package main
+package chrootprep
 
 import (
 	"fmt"
@@ -99,3 +99,30 @@ func removeIfExists(path string) error {
 
 	return os.RemoveAll(path)
 }
+
+// emptyDir removes everything inside a directory but keeps the directory itself
+func emptyDir(path string) error {
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return fmt.Errorf("failed to read directory %s: %w", path, err)
+	}
+
+	for _, entry := range entries {
+		if err := os.RemoveAll(filepath.Join(path, entry.Name())); err != nil {
+			return fmt.Errorf("failed to remove %s: %w", entry.Name(), err)
+		}
+	}
+
+	return nil
+}
+
+// copyTree copies the contents of src into the existing directory dst.
+// Ownership, modes, xattrs, hardlinks and special files are preserved,
+// and reflinks are used when the filesystem supports them.
+func (op *operation) copyTree(src, dst string) error {
+	cmd := op.command("cp", "--archive", "--reflink=auto", src+"/.", dst)
+	if err := op.runCommand(cmd); err != nil {
+		return fmt.Errorf("failed to copy %s to %s: %w", src, dst, err)
+	}
+	return nil
+}
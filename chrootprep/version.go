@@ -0,0 +1,127 @@
+package chrootprep
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// VersionSeparator separates a base name from its version (e.g. trixie-amd64@2026-10-16)
+const VersionSeparator = "@"
+
+// validVersion matches version names that are safe in directory names and
+// cannot be mistaken for an overlay suffix
+var validVersion = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// BaseVersion records the lineage of a versioned base created by snapshot
+type BaseVersion struct {
+	Version string `json:"version"`
+	// Source is the base the snapshotted overlay was created on
+	Source  string    `json:"source"`
+	Overlay string    `json:"overlay"`
+	Parents []string  `json:"parents,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+// getVersionDir returns the directory of a version of a base. Versions of
+// versions share the name of the original base.
+func getVersionDir(chrootDir string, version string) string {
+	name, _, _ := strings.Cut(filepath.Base(chrootDir), VersionSeparator)
+	return filepath.Join(filepath.Dir(chrootDir), name+VersionSeparator+version)
+}
+
+// getLineagePath returns the path of the lineage file stored next to a versioned base
+func getLineagePath(versionDir string) string {
+	return versionDir + ".json"
+}
+
+// isVersionBase checks if a base is a version created by snapshot
+func isVersionBase(chrootDir string) bool {
+	_, version, found := strings.Cut(filepath.Base(chrootDir), VersionSeparator)
+	return found && validVersion.MatchString(version) && fileExists(getLineagePath(chrootDir))
+}
+
+// findVersions returns the versioned bases sharing the name of a base, with their lineage
+func findVersions(chrootDir string) []BaseVersion {
+	parentDir := filepath.Dir(chrootDir)
+	entries, err := os.ReadDir(parentDir)
+	if err != nil {
+		return nil
+	}
+
+	baseName, _, _ := strings.Cut(filepath.Base(chrootDir), VersionSeparator)
+	prefix := baseName + VersionSeparator
+
+	var versions []BaseVersion
+	for _, entry := range entries {
+		if !entry.IsDir() || !strings.HasPrefix(entry.Name(), prefix) {
+			continue
+		}
+
+		// Overlays of versioned bases (<base>@<version>.<name>) are not versions
+		name := entry.Name()[len(prefix):]
+		if !validVersion.MatchString(name) {
+			continue
+		}
+
+		version := BaseVersion{Version: name}
+		if content, err := os.ReadFile(getLineagePath(filepath.Join(parentDir, entry.Name()))); err == nil {
+			json.Unmarshal(content, &version)
+		}
+
+		versions = append(versions, version)
+	}
+
+	return versions
+}
+
+// snapshotOverlay materializes the merged view of an overlay as a new versioned base
+func (op *operation) snapshotOverlay(chrootDir string, overlayName string, version string) (string, error) {
+	if !validVersion.MatchString(version) {
+		return "", fmt.Errorf("invalid version '%s' (use letters, digits, '-' and '_')", version)
+	}
+
+	if err := op.validateOverlayStructure(chrootDir, overlayName); err != nil {
+		return "", err
+	}
+
+	meta, err := op.readOverlayMetadata(chrootDir, overlayName)
+	if err != nil {
+		return "", err
+	}
+
+	versionDir := getVersionDir(chrootDir, version)
+	if pathExists(versionDir) {
+		return "", fmt.Errorf("version '%s' %w at %s", version, ErrExist, versionDir)
+	}
+
+	if err := op.materializeOverlay(chrootDir, overlayName, versionDir); err != nil {
+		return "", err
+	}
+
+	// Record where the version came from
+	lineage := BaseVersion{
+		Version: version,
+		Source:  chrootDir,
+		Overlay: overlayName,
+		Created: time.Now().UTC(),
+	}
+	if meta != nil {
+		lineage.Parents = meta.Parents
+	}
+
+	content, err := json.MarshalIndent(lineage, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("failed to encode lineage: %w", err)
+	}
+
+	if err := os.WriteFile(getLineagePath(versionDir), append(content, '\n'), 0644); err != nil {
+		return "", fmt.Errorf("failed to write lineage: %w", err)
+	}
+
+	return versionDir, nil
+}
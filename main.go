@@ -1,10 +1,17 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/zinrai/chroot-prep/chrootprep"
 )
 
 func main() {
@@ -13,20 +20,111 @@ func main() {
 		os.Exit(1)
 	}
 
+	// Long copies and image builds stop on Ctrl-C
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	// Subcommands
 	setupCmd := flag.NewFlagSet("setup", flag.ExitOnError)
 	setupDir := setupCmd.String("dir", "", "Path to chroot environment (required)")
+	setupOverlayRoot := setupCmd.String("overlay-root", "", "Store overlays under this directory")
 	setupOverlay := setupCmd.Bool("overlay", false, "Use OverlayFS for chroot environment")
+	setupTmpfs := setupCmd.Bool("tmpfs", false, "Keep overlay upper and work on a tmpfs")
+	setupSize := setupCmd.String("size", "", "Size limit of the overlay tmpfs (e.g. 2G)")
+	setupBackend := setupCmd.String("backend", "", "Layering backend of a new overlay: overlay, btrfs or copy (default: overlay)")
+	setupAllowCopy := setupCmd.Bool("allow-copy", false, "Use a copy of the base when overlayfs cannot be mounted")
+	setupQuota := setupCmd.String("quota", "", "Size limit of a new disk-backed overlay (e.g. 10G)")
+	setupFrom := setupCmd.String("from", "", "Stack a new overlay on top of this overlay")
+	setupReadOnly := setupCmd.Bool("readonly", false, "Mount an immutable view for inspection")
+	setupProtectBase := setupCmd.Bool("protect-base", false, "Keep the base read-only while overlays are mounted")
+	setupAcceptDrift := setupCmd.Bool("accept-drift", false, "Mount the overlay even if its base has changed")
+	setupOptions := setupCmd.String("options", "", "Extra overlayfs mount options (e.g. metacopy=on,index=on)")
+	setupEnsure := setupCmd.Bool("ensure", false, "Complete an existing setup instead of failing, mounting only what is missing")
 
 	cleanupCmd := flag.NewFlagSet("cleanup", flag.ExitOnError)
 	cleanupDir := cleanupCmd.String("dir", "", "Path to chroot environment (required)")
+	cleanupOverlayRoot := cleanupCmd.String("overlay-root", "", "Store overlays under this directory")
 	cleanupOverlay := cleanupCmd.Bool("overlay", false, "Cleanup overlay environment")
+	cleanupAll := cleanupCmd.Bool("all", false, "Cleanup the base and all of its overlays")
 
 	removeCmd := flag.NewFlagSet("remove", flag.ExitOnError)
 	removeDir := removeCmd.String("dir", "", "Path to chroot environment to remove (required)")
+	removeOverlayRoot := removeCmd.String("overlay-root", "", "Store overlays under this directory")
 	removeForce := removeCmd.Bool("force", false, "Force removal even if unmount fails")
 	removeOverlay := removeCmd.Bool("overlay", false, "Remove overlay directory")
 
+	listCmd := flag.NewFlagSet("list", flag.ExitOnError)
+	listDir := listCmd.String("dir", "", "Path to base chroot environment (required)")
+	listOverlayRoot := listCmd.String("overlay-root", "", "Store overlays under this directory")
+
+	statusCmd := flag.NewFlagSet("status", flag.ExitOnError)
+	statusDir := statusCmd.String("dir", "", "Path to base chroot environment (required)")
+	statusOverlayRoot := statusCmd.String("overlay-root", "", "Store overlays under this directory")
+	statusOverlay := statusCmd.Bool("overlay", false, "Overlay to show")
+
+	checkCmd := flag.NewFlagSet("check", flag.ExitOnError)
+	checkDir := checkCmd.String("dir", "", "Path to base chroot environment (required)")
+	checkOverlayRoot := checkCmd.String("overlay-root", "", "Store overlays under this directory")
+	checkOverlay := checkCmd.Bool("overlay", false, "Overlay to check")
+	checkOptions := checkCmd.String("options", "", "Extra overlayfs mount options of a new overlay")
+
+	doctorCmd := flag.NewFlagSet("doctor", flag.ExitOnError)
+	doctorDir := doctorCmd.String("dir", "", "Also scan the overlays of this base chroot environment")
+	doctorOverlayRoot := doctorCmd.String("overlay-root", "", "Store overlays under this directory")
+	doctorFix := doctorCmd.Bool("fix", false, "Repair the problems found")
+	doctorDeleteOrphans := doctorCmd.Bool("delete-orphans", false, "Let -fix delete overlays whose base no longer exists")
+
+	importCmd := flag.NewFlagSet("import", flag.ExitOnError)
+	importDir := importCmd.String("dir", "", "Path to create the chroot environment in (required)")
+	importOCI := importCmd.String("oci", "", "Path to a local OCI image layout")
+	importTar := importCmd.String("tar", "", "Path to a rootfs tarball (.tar, .tar.gz, .tar.zst)")
+
+	cloneCmd := flag.NewFlagSet("clone", flag.ExitOnError)
+	cloneDir := cloneCmd.String("dir", "", "Path to base chroot environment (required)")
+	cloneOverlayRoot := cloneCmd.String("overlay-root", "", "Store overlays under this directory")
+	cloneOverlay := cloneCmd.Bool("overlay", false, "Overlay to clone")
+	cloneTo := cloneCmd.String("to", "", "Name of the new overlay (required)")
+
+	resetCmd := flag.NewFlagSet("reset", flag.ExitOnError)
+	resetDir := resetCmd.String("dir", "", "Path to base chroot environment (required)")
+	resetOverlayRoot := resetCmd.String("overlay-root", "", "Store overlays under this directory")
+	resetOverlay := resetCmd.Bool("overlay", false, "Overlay to reset")
+	resetRemount := resetCmd.Bool("remount", false, "Set up the overlay again after resetting")
+
+	snapshotCmd := flag.NewFlagSet("snapshot", flag.ExitOnError)
+	snapshotDir := snapshotCmd.String("dir", "", "Path to base chroot environment (required)")
+	snapshotOverlayRoot := snapshotCmd.String("overlay-root", "", "Store overlays under this directory")
+	snapshotOverlay := snapshotCmd.Bool("overlay", false, "Overlay to snapshot")
+	snapshotAs := snapshotCmd.String("as", "", "Version name of the new base (required)")
+
+	flattenCmd := flag.NewFlagSet("flatten", flag.ExitOnError)
+	flattenDir := flattenCmd.String("dir", "", "Path to base chroot environment (required)")
+	flattenOverlayRoot := flattenCmd.String("overlay-root", "", "Store overlays under this directory")
+	flattenOverlay := flattenCmd.Bool("overlay", false, "Overlay to flatten")
+	flattenTo := flattenCmd.String("to", "", "Path of the new standalone environment (required)")
+
+	splitCmd := flag.NewFlagSet("split", flag.ExitOnError)
+	splitDir := splitCmd.String("dir", "", "Path to pristine base chroot environment (required)")
+	splitOverlayRoot := splitCmd.String("overlay-root", "", "Store overlays under this directory")
+	splitOverlay := splitCmd.Bool("overlay", false, "Overlay to create")
+	splitModified := splitCmd.String("modified", "", "Path to the modified full environment (required)")
+
+	diffCmd := flag.NewFlagSet("diff", flag.ExitOnError)
+	diffDir := diffCmd.String("dir", "", "Path to base chroot environment (required)")
+	diffOverlayRoot := diffCmd.String("overlay-root", "", "Store overlays under this directory")
+	diffOverlay := diffCmd.Bool("overlay", false, "Overlay to compare")
+	diffAgainst := diffCmd.String("against", "", "Overlay to compare against (required)")
+	diffContent := diffCmd.Bool("content", false, "Show content diffs of changed files")
+
+	packCmd := flag.NewFlagSet("pack", flag.ExitOnError)
+	packDir := packCmd.String("dir", "", "Path to base chroot environment (required)")
+	packOutput := packCmd.String("o", "", "Path of the image to build (required)")
+	packFormat := packCmd.String("format", "", "Image format: squashfs or erofs (default: from the extension)")
+
+	exportCmd := flag.NewFlagSet("export", flag.ExitOnError)
+	exportDir := exportCmd.String("dir", "", "Path to chroot environment to export (required)")
+	exportOutput := exportCmd.String("o", "", "Output tarball (.tar, .tar.gz, .tar.zst) (required)")
+
 	// Parse subcommands
 	switch os.Args[1] {
 	case "setup":
@@ -34,21 +132,37 @@ func main() {
 			log.Fatalf("Failed to parse setup command: %v", err)
 		}
 
+		// Handle overlay with optional name
+		overlayName := overlayNameArg(setupCmd, *setupOverlay)
+
 		if *setupDir == "" {
 			log.Fatal("Please specify chroot directory using -dir flag")
 		}
 
-		// Handle overlay with optional name
-		overlayName := ""
-		if *setupOverlay {
-			overlayName = "overlay" // default
-			args := setupCmd.Args()
-			if len(args) > 0 {
-				overlayName = args[0]
-			}
+		// Accept an overlay directory or a path inside its merged view as -dir
+		env := resolveDirArg(*setupDir, *setupOverlayRoot, overlayName)
+
+		if *setupSize != "" && !*setupTmpfs {
+			log.Fatal("The -size flag requires -tmpfs")
+		}
+
+		opts := chrootprep.SetupOptions{
+			Tmpfs:       *setupTmpfs,
+			TmpfsSize:   *setupSize,
+			Quota:       *setupQuota,
+			Backend:     *setupBackend,
+			AllowCopy:   *setupAllowCopy,
+			From:        *setupFrom,
+			ReadOnly:    *setupReadOnly,
+			ProtectBase: *setupProtectBase,
+			AcceptDrift: *setupAcceptDrift,
+			Ensure:      *setupEnsure,
+		}
+		if *setupOptions != "" {
+			opts.MountOptions = strings.Split(*setupOptions, ",")
 		}
 
-		if err := Setup(*setupDir, overlayName); err != nil {
+		if err := env.Setup(ctx, opts); err != nil {
 			log.Fatalf("Failed to setup: %v", err)
 		}
 
@@ -57,21 +171,27 @@ func main() {
 			log.Fatalf("Failed to parse cleanup command: %v", err)
 		}
 
+		// Handle overlay with optional name
+		overlayName := overlayNameArg(cleanupCmd, *cleanupOverlay)
+
 		if *cleanupDir == "" {
 			log.Fatal("Please specify chroot directory using -dir flag")
 		}
 
-		// Handle overlay with optional name
-		overlayName := ""
-		if *cleanupOverlay {
-			overlayName = "overlay" // default
-			args := cleanupCmd.Args()
-			if len(args) > 0 {
-				overlayName = args[0]
+		// Accept an overlay directory or a path inside its merged view as -dir
+		env := resolveDirArg(*cleanupDir, *cleanupOverlayRoot, overlayName)
+
+		if *cleanupAll {
+			if env.Overlay() != "" {
+				log.Fatal("The -all flag cannot be combined with -overlay")
 			}
-		}
 
-		if err := Cleanup(*cleanupDir, overlayName); err != nil {
+			results, err := env.CleanupAll(ctx)
+			printCleanupResults(env.Dir(), results)
+			if err != nil {
+				log.Fatalf("Failed to cleanup: %v", err)
+			}
+		} else if err := env.Cleanup(ctx); err != nil {
 			log.Fatalf("Failed to cleanup: %v", err)
 		}
 
@@ -80,22 +200,360 @@ func main() {
 			log.Fatalf("Failed to parse remove command: %v", err)
 		}
 
+		// Handle overlay with optional name
+		overlayName := overlayNameArg(removeCmd, *removeOverlay)
+
 		if *removeDir == "" {
 			log.Fatal("Please specify chroot directory using -dir flag")
 		}
 
+		// Accept an overlay directory or a path inside its merged view as -dir
+		env := resolveDirArg(*removeDir, *removeOverlayRoot, overlayName)
+
+		if err := env.Remove(ctx, chrootprep.RemoveOptions{Force: *removeForce}); err != nil {
+			log.Fatalf("Failed to remove: %v", err)
+		}
+
+	case "clone":
+		if err := cloneCmd.Parse(os.Args[2:]); err != nil {
+			log.Fatalf("Failed to parse clone command: %v", err)
+		}
+
+		// Handle overlay with optional name
+		overlayName := overlayNameArg(cloneCmd, *cloneOverlay)
+
+		if *cloneDir == "" {
+			log.Fatal("Please specify chroot directory using -dir flag")
+		}
+
+		// Accept an overlay directory or a path inside its merged view as -dir
+		env := resolveDirArg(*cloneDir, *cloneOverlayRoot, overlayName)
+
+		if env.Overlay() == "" {
+			log.Fatal("Please specify the overlay to clone using -overlay flag")
+		}
+
+		if *cloneTo == "" {
+			log.Fatal("Please specify the new overlay name using -to flag")
+		}
+
+		if err := env.Clone(ctx, *cloneTo); err != nil {
+			log.Fatalf("Failed to clone: %v", err)
+		}
+		fmt.Printf("Use: sudo chroot-prep setup -dir %s -overlay %s\n", env.Dir(), *cloneTo)
+
+	case "reset":
+		if err := resetCmd.Parse(os.Args[2:]); err != nil {
+			log.Fatalf("Failed to parse reset command: %v", err)
+		}
+
+		// Handle overlay with optional name
+		overlayName := overlayNameArg(resetCmd, *resetOverlay)
+
+		if *resetDir == "" {
+			log.Fatal("Please specify chroot directory using -dir flag")
+		}
+
+		// Accept an overlay directory or a path inside its merged view as -dir
+		env := resolveDirArg(*resetDir, *resetOverlayRoot, overlayName)
+
+		if env.Overlay() == "" {
+			log.Fatal("Please specify the overlay to reset using -overlay flag")
+		}
+
+		if err := env.Reset(ctx, chrootprep.ResetOptions{Remount: *resetRemount}); err != nil {
+			log.Fatalf("Failed to reset: %v", err)
+		}
+
+	case "list":
+		if err := listCmd.Parse(os.Args[2:]); err != nil {
+			log.Fatalf("Failed to parse list command: %v", err)
+		}
+
+		if *listDir == "" {
+			log.Fatal("Please specify chroot directory using -dir flag")
+		}
+
+		// Accept an overlay directory or a path inside its merged view as -dir
+		env := resolveDirArg(*listDir, *listOverlayRoot, "")
+
+		listing, err := env.List(ctx)
+		if err != nil {
+			log.Fatalf("Failed to list: %v", err)
+		}
+		printListing(listing)
+
+	case "status":
+		if err := statusCmd.Parse(os.Args[2:]); err != nil {
+			log.Fatalf("Failed to parse status command: %v", err)
+		}
+
 		// Handle overlay with optional name
-		overlayName := ""
-		if *removeOverlay {
-			overlayName = "overlay" // default
-			args := removeCmd.Args()
-			if len(args) > 0 {
-				overlayName = args[0]
+		overlayName := overlayNameArg(statusCmd, *statusOverlay)
+
+		if *statusDir == "" {
+			log.Fatal("Please specify chroot directory using -dir flag")
+		}
+
+		// Accept an overlay directory or a path inside its merged view as -dir
+		env := resolveDirArg(*statusDir, *statusOverlayRoot, overlayName)
+
+		if env.Overlay() == "" {
+			log.Fatal("Please specify the overlay to show using -overlay flag")
+		}
+
+		status, err := env.Status(ctx)
+		if err != nil {
+			log.Fatalf("Failed to show status: %v", err)
+		}
+		printStatus(status)
+
+	case "check":
+		if err := checkCmd.Parse(os.Args[2:]); err != nil {
+			log.Fatalf("Failed to parse check command: %v", err)
+		}
+
+		// Handle overlay with optional name
+		overlayName := overlayNameArg(checkCmd, *checkOverlay)
+
+		if *checkDir == "" {
+			log.Fatal("Please specify chroot directory using -dir flag")
+		}
+
+		// Accept an overlay directory or a path inside its merged view as -dir
+		env := resolveDirArg(*checkDir, *checkOverlayRoot, overlayName)
+
+		// Check the default overlay without -overlay
+		if env.Overlay() == "" {
+			env, _ = env.WithOverlay("overlay")
+		}
+
+		var opts chrootprep.CheckOptions
+		if *checkOptions != "" {
+			opts.MountOptions = strings.Split(*checkOptions, ",")
+		}
+
+		fmt.Printf("Checking overlay '%s' of %s\n", env.Overlay(), env.Dir())
+		results, err := env.Check(ctx, opts)
+		printCheckResults(results)
+		if err != nil {
+			log.Fatalf("Failed preflight checks: %v", err)
+		}
+		if len(results) > 0 {
+			fmt.Printf("Overlay '%s' can be set up\n", env.Overlay())
+		}
+
+	case "doctor":
+		if err := doctorCmd.Parse(os.Args[2:]); err != nil {
+			log.Fatalf("Failed to parse doctor command: %v", err)
+		}
+
+		// Accept an overlay directory or a path inside its merged view as -dir
+		if *doctorDir != "" {
+			*doctorDir = resolveDirArg(*doctorDir, *doctorOverlayRoot, "").Dir()
+		}
+
+		doctorOpts := chrootprep.DoctorOptions{Fix: *doctorFix, DeleteOrphans: *doctorDeleteOrphans}
+		issues, err := chrootprep.Doctor(ctx, *doctorDir, doctorOpts, environmentOptions(*doctorOverlayRoot))
+		printIssues(issues, *doctorFix)
+		if err != nil {
+			log.Fatalf("Doctor failed: %v", err)
+		}
+
+		switch {
+		case len(issues) == 0:
+			fmt.Printf("No problems found\n")
+		case !*doctorFix:
+			log.Fatalf("Doctor failed: %d problem(s) found, run with -fix to repair them", len(issues))
+		default:
+			skipped := 0
+			for _, issue := range issues {
+				if issue.Skipped {
+					skipped++
+				}
+			}
+			fmt.Printf("Repaired %d problem(s)\n", len(issues)-skipped)
+			if skipped > 0 {
+				fmt.Printf("Skipped %d problem(s)\n", skipped)
 			}
 		}
 
-		if err := Remove(*removeDir, *removeForce, overlayName); err != nil {
-			log.Fatalf("Failed to remove: %v", err)
+	case "snapshot":
+		if err := snapshotCmd.Parse(os.Args[2:]); err != nil {
+			log.Fatalf("Failed to parse snapshot command: %v", err)
+		}
+
+		// Handle overlay with optional name
+		overlayName := overlayNameArg(snapshotCmd, *snapshotOverlay)
+
+		if *snapshotDir == "" {
+			log.Fatal("Please specify chroot directory using -dir flag")
+		}
+
+		// Accept an overlay directory or a path inside its merged view as -dir
+		env := resolveDirArg(*snapshotDir, *snapshotOverlayRoot, overlayName)
+
+		if env.Overlay() == "" {
+			log.Fatal("Please specify the overlay to snapshot using -overlay flag")
+		}
+
+		if *snapshotAs == "" {
+			log.Fatal("Please specify the version name using -as flag")
+		}
+
+		versionDir, err := env.Snapshot(ctx, *snapshotAs)
+		if err != nil {
+			log.Fatalf("Failed to snapshot: %v", err)
+		}
+		fmt.Printf("Base: %s\n", versionDir)
+		fmt.Printf("Use: sudo chroot-prep setup -dir %s -overlay [name]\n", versionDir)
+
+	case "flatten":
+		if err := flattenCmd.Parse(os.Args[2:]); err != nil {
+			log.Fatalf("Failed to parse flatten command: %v", err)
+		}
+
+		// Handle overlay with optional name
+		overlayName := overlayNameArg(flattenCmd, *flattenOverlay)
+
+		if *flattenDir == "" {
+			log.Fatal("Please specify chroot directory using -dir flag")
+		}
+
+		// Accept an overlay directory or a path inside its merged view as -dir
+		env := resolveDirArg(*flattenDir, *flattenOverlayRoot, overlayName)
+
+		if env.Overlay() == "" {
+			log.Fatal("Please specify the overlay to flatten using -overlay flag")
+		}
+
+		if *flattenTo == "" {
+			log.Fatal("Please specify the new environment using -to flag")
+		}
+
+		if err := env.Flatten(ctx, *flattenTo); err != nil {
+			log.Fatalf("Failed to flatten: %v", err)
+		}
+
+	case "split":
+		if err := splitCmd.Parse(os.Args[2:]); err != nil {
+			log.Fatalf("Failed to parse split command: %v", err)
+		}
+
+		// Handle overlay with optional name
+		overlayName := overlayNameArg(splitCmd, *splitOverlay)
+
+		if *splitDir == "" {
+			log.Fatal("Please specify chroot directory using -dir flag")
+		}
+
+		if overlayName == "" {
+			log.Fatal("Please specify the overlay to create using -overlay flag")
+		}
+
+		env := newEnvironment(*splitDir, overlayName, environmentOptions(*splitOverlayRoot))
+
+		if *splitModified == "" {
+			log.Fatal("Please specify the modified environment using -modified flag")
+		}
+
+		if err := env.Split(ctx, *splitModified); err != nil {
+			log.Fatalf("Failed to split: %v", err)
+		}
+		fmt.Printf("Use: sudo chroot-prep setup -dir %s -overlay %s\n", env.Dir(), env.Overlay())
+
+	case "diff":
+		if err := diffCmd.Parse(os.Args[2:]); err != nil {
+			log.Fatalf("Failed to parse diff command: %v", err)
+		}
+
+		// Handle overlay with optional name
+		overlayName := overlayNameArg(diffCmd, *diffOverlay)
+
+		if *diffDir == "" {
+			log.Fatal("Please specify chroot directory using -dir flag")
+		}
+
+		// Accept an overlay directory or a path inside its merged view as -dir
+		env := resolveDirArg(*diffDir, *diffOverlayRoot, overlayName)
+
+		if env.Overlay() == "" {
+			log.Fatal("Please specify the overlay to compare using -overlay flag")
+		}
+
+		if *diffAgainst == "" {
+			log.Fatal("Please specify the overlay to compare against using -against flag")
+		}
+
+		stats, err := env.Diff(ctx, *diffAgainst, chrootprep.DiffOptions{Output: os.Stdout, Content: *diffContent})
+		if err != nil {
+			log.Fatalf("Failed to diff: %v", err)
+		}
+		fmt.Printf("Added: %d, removed: %d, changed: %d\n", stats.Added, stats.Removed, stats.Changed)
+
+	case "pack":
+		if err := packCmd.Parse(os.Args[2:]); err != nil {
+			log.Fatalf("Failed to parse pack command: %v", err)
+		}
+
+		if *packDir == "" {
+			log.Fatal("Please specify chroot directory using -dir flag")
+		}
+
+		if *packOutput == "" {
+			log.Fatal("Please specify the image to build using -o flag")
+		}
+
+		env := newEnvironment(*packDir, "", environmentOptions(""))
+		if err := env.Pack(ctx, *packOutput, chrootprep.PackOptions{Format: *packFormat}); err != nil {
+			log.Fatalf("Failed to pack: %v", err)
+		}
+		image, _ := filepath.Abs(*packOutput)
+		fmt.Printf("Use: sudo chroot-prep setup -dir %s -overlay [name]\n", image)
+
+	case "import":
+		if err := importCmd.Parse(os.Args[2:]); err != nil {
+			log.Fatalf("Failed to parse import command: %v", err)
+		}
+
+		if *importDir == "" {
+			log.Fatal("Please specify chroot directory using -dir flag")
+		}
+
+		env := newEnvironment(*importDir, "", environmentOptions(""))
+
+		var err error
+		switch {
+		case *importOCI != "" && *importTar != "":
+			log.Fatal("Please specify only one of -oci and -tar")
+		case *importOCI != "":
+			err = env.ImportOCI(ctx, *importOCI)
+		case *importTar != "":
+			err = env.ImportTar(ctx, *importTar)
+		default:
+			log.Fatal("Please specify an image source using -oci or -tar flag")
+		}
+
+		if err != nil {
+			log.Fatalf("Failed to import: %v", err)
+		}
+
+	case "export":
+		if err := exportCmd.Parse(os.Args[2:]); err != nil {
+			log.Fatalf("Failed to parse export command: %v", err)
+		}
+
+		if *exportDir == "" {
+			log.Fatal("Please specify chroot directory using -dir flag")
+		}
+
+		if *exportOutput == "" {
+			log.Fatal("Please specify output tarball using -o flag")
+		}
+
+		env := newEnvironment(*exportDir, "", environmentOptions(""))
+		if err := env.Export(ctx, *exportOutput); err != nil {
+			log.Fatalf("Failed to export: %v", err)
 		}
 
 	default:
@@ -104,32 +562,199 @@ func main() {
 	}
 }
 
+// overlayNameArg returns the overlay name given after -overlay, or "" when
+// overlay mode is not enabled. Flags following the name are parsed as well.
+func overlayNameArg(cmd *flag.FlagSet, enabled bool) string {
+	if !enabled {
+		return ""
+	}
+
+	overlayName := "overlay" // default
+	args := cmd.Args()
+	if len(args) > 0 {
+		overlayName = args[0]
+		if err := cmd.Parse(args[1:]); err != nil {
+			log.Fatalf("Failed to parse %s command: %v", cmd.Name(), err)
+		}
+	}
+
+	return overlayName
+}
+
+// environmentOptions returns the options of a command's environments: the
+// overlay root given with -overlay-root, or else in the configuration file,
+// and progress messages on stdout
+func environmentOptions(root string) chrootprep.Options {
+	if root == "" {
+		config, err := chrootprep.LoadConfig(chrootprep.ConfigPath)
+		if err != nil {
+			log.Fatalf("Failed to configure overlay root: %v", err)
+		}
+		root = config.OverlayRoot
+	}
+
+	return chrootprep.Options{OverlayRoot: root, Logger: log.New(os.Stdout, "", 0)}
+}
+
+// newEnvironment returns the environment of a command's -dir argument
+func newEnvironment(dir string, overlayName string, opts chrootprep.Options) *chrootprep.Environment {
+	env, err := chrootprep.New(dir, overlayName, opts)
+	if err != nil {
+		log.Fatalf("Failed to open %s: %v", dir, err)
+	}
+	return env
+}
+
+// resolveDirArg returns the environment of a command's -dir argument. An
+// overlay directory, or any path inside the merged view of an overlay,
+// designates that overlay of its base.
+func resolveDirArg(dir string, root string, overlayName string) *chrootprep.Environment {
+	env, err := chrootprep.Resolve(dir, overlayName, environmentOptions(root))
+	if err != nil {
+		log.Fatalf("Failed to resolve %s: %v", dir, err)
+	}
+	return env
+}
+
 func printUsage() {
 	const usage = `chroot-prep - Manage filesystem mounts for chroot environments
 
 Usage:
-  chroot-prep setup -dir /path/to/chroot [-overlay [name]]
-  chroot-prep cleanup -dir /path/to/chroot [-overlay [name]]
+  chroot-prep setup -dir /path/to/chroot [-ensure] [-readonly] [-overlay [name] [-from parent] [-options opts] [-protect-base] [-accept-drift] [-backend overlay|btrfs|copy] [-allow-copy] [-tmpfs [-size 2G] | -quota 10G]]
+  chroot-prep cleanup -dir /path/to/chroot [-overlay [name] | -all]
   chroot-prep remove -dir /path/to/chroot [-force] [-overlay [name]]
+  chroot-prep list -dir /path/to/chroot
+  chroot-prep status -dir /path/to/chroot -overlay [name]
+  chroot-prep check -dir /path/to/chroot [-overlay [name]] [-options opts]
+  chroot-prep doctor [-dir /path/to/chroot] [-fix [-delete-orphans]]
+  chroot-prep clone -dir /path/to/chroot -overlay [name] -to newname
+  chroot-prep reset -dir /path/to/chroot -overlay [name] [-remount]
+  chroot-prep snapshot -dir /path/to/chroot -overlay [name] -as version
+  chroot-prep flatten -dir /path/to/chroot -overlay [name] -to /path/to/new
+  chroot-prep split -dir /path/to/chroot -modified /path/to/modified -overlay [name]
+  chroot-prep diff -dir /path/to/chroot -overlay [name] -against name [-content]
+  chroot-prep pack -dir /path/to/chroot -o base.squashfs [-format squashfs|erofs]
+  chroot-prep import (-oci /path/to/image | -tar rootfs.tar) -dir /path/to/chroot
+  chroot-prep export -dir /path/to/chroot -o rootfs.tar[.gz|.zst]
 
 Commands:
   setup    Setup chroot environment with essential filesystems
   cleanup  Cleanup mounted filesystems from chroot environment
   remove   Remove chroot environment (with automatic unmounting)
+  list     List the overlays of a base chroot environment
+  status   Show the state, storage and disk usage of an overlay
+  check    Check that the kernel and filesystems can hold an overlay
+  doctor   Find and repair stale mounts and orphaned overlays
+  clone    Copy an overlay's changes into a new overlay
+  reset    Discard an overlay's changes without removing it
+  snapshot Freeze an overlay's merged view as a new versioned base
+  flatten  Copy an overlay's merged view into a standalone environment
+  split    Turn a modified copy of a base into an overlay of that base
+  diff     Show the differences between two overlays
+  pack     Build a squashfs or erofs image from a base directory
+  import   Create a base chroot environment from an image or tarball
+  export   Write a chroot environment to a rootfs tarball
 
 Setup Options:
-  -dir string    Path to chroot directory (required)
+  -dir string    Path to chroot directory or squashfs/erofs/ext4 image (required)
   -overlay       Use OverlayFS (optionally specify name, default: 'overlay')
+  -readonly      Mount an immutable view (read-only bind, or lower-only overlay)
+  -ensure        Complete an existing setup instead of failing, mounting only
+                 what is missing (safe to run repeatedly)
+  -from string   Stack a new overlay on top of another overlay
+  -options string
+                 Extra overlayfs mount options, recorded for later setups
+                 (index, nfs_export, metacopy, redirect_dir, xino, volatile, userxattr)
+  -protect-base  Bind the base read-only over itself while overlays are mounted
+  -accept-drift  Mount the overlay even if its base has changed since creation
+  -tmpfs         Keep upper and work on a tmpfs, discarded on cleanup
+  -size string   Size limit of the tmpfs (e.g. 2G)
+  -quota string  Keep a new overlay on an ext4 image of this size (e.g. 10G)
+  -backend string
+                 Layering backend of a new overlay: overlay, btrfs or copy (default: overlay)
+  -allow-copy    Use a copy of the base for a new overlay when overlayfs cannot be mounted
 
 Cleanup Options:
   -dir string    Path to chroot directory (required)
   -overlay       Cleanup overlay (optionally specify name, default: 'overlay')
+  -all           Cleanup the base and all of its overlays, keeping their changes
 
 Remove Options:
   -dir string    Path to chroot directory (required)
   -force         Force removal even if unmount fails
   -overlay       Remove only overlay (optionally specify name, default: 'overlay')
 
+Status Options:
+  -dir string    Path to base chroot directory (required)
+  -overlay       Overlay to show (optionally specify name, default: 'overlay')
+
+Check Options:
+  -dir string    Path to base chroot directory or image (required)
+  -overlay       Overlay to check (optionally specify name, default: 'overlay')
+  -options string
+                 Extra overlayfs mount options of a new overlay
+
+Doctor Options:
+  -dir string    Also scan the overlays of this base chroot directory
+  -fix           Repair the problems found
+  -delete-orphans
+                 Let -fix delete overlays whose base no longer exists
+
+Common Options (setup, cleanup, remove, list, status, check, doctor, clone, reset, snapshot, flatten, split, diff):
+  -overlay-root string
+                 Store overlays under <root>/<base name>/<name> instead of
+                 next to the base (default: overlay_root in /etc/chroot-prep.json)
+
+  Except with split, -dir may also be an overlay directory, its merged
+  directory or any path below them, designating that overlay of its base.
+
+Clone Options:
+  -dir string    Path to base chroot directory (required)
+  -overlay       Overlay to clone (optionally specify name, default: 'overlay')
+  -to string     Name of the new overlay (required)
+
+Reset Options:
+  -dir string    Path to base chroot directory (required)
+  -overlay       Overlay to reset (optionally specify name, default: 'overlay')
+  -remount       Set up the overlay again after resetting
+
+Snapshot Options:
+  -dir string    Path to base chroot directory (required)
+  -overlay       Overlay to snapshot (optionally specify name, default: 'overlay')
+  -as string     Version name; the new base is created as <base>@<version> (required)
+
+Flatten Options:
+  -dir string    Path to base chroot directory (required)
+  -overlay       Overlay to flatten (optionally specify name, default: 'overlay')
+  -to string     Path of the new standalone environment (required)
+
+Split Options:
+  -dir string    Path to pristine base chroot directory (required)
+  -modified string
+                 Path to the modified full environment (required)
+  -overlay       Overlay to create (optionally specify name, default: 'overlay')
+
+Diff Options:
+  -dir string    Path to base chroot directory (required)
+  -overlay       Overlay to compare (optionally specify name, default: 'overlay')
+  -against string
+                 Overlay to compare against (required)
+  -content       Show content diffs of changed files
+
+Pack Options:
+  -dir string    Path to base chroot directory (required)
+  -o string      Path of the image to build (required)
+  -format string Image format: squashfs or erofs (default: from the extension)
+
+Import Options:
+  -dir string    Path to new or empty chroot directory (required)
+  -oci string    Path to a local OCI image layout (index, manifests, blobs)
+  -tar string    Path to a rootfs tarball (.tar, .tar.gz, .tar.zst)
+
+Export Options:
+  -dir string    Path to chroot directory (required)
+  -o string      Output tarball, compression chosen by extension (required)
+
 Examples:
   # Normal chroot setup
   sudo chroot-prep setup -dir /mnt/my-chroot
@@ -140,15 +765,76 @@ Examples:
   # OverlayFS with custom name
   sudo chroot-prep setup -dir /mnt/base -overlay projectA
 
+  # Provisioning step that can run any number of times
+  sudo chroot-prep setup -dir /mnt/base -overlay projectA -ensure
+
+  # Inspect an overlay without any chance of writes
+  sudo chroot-prep setup -dir /mnt/base -overlay projectA -readonly
+
+  # Overlay stacked on top of another overlay
+  sudo chroot-prep setup -dir /mnt/base -overlay projectA -from toolchain
+
+  # Overlay with fast metadata-only copy-up
+  sudo chroot-prep setup -dir /mnt/base -overlay projectA -options metacopy=on,index=on
+
+  # Throwaway overlay kept in memory
+  sudo chroot-prep setup -dir /mnt/base -overlay scratch -tmpfs -size 2G
+
+  # Overlay that cannot grow beyond 10G
+  sudo chroot-prep setup -dir /mnt/base -overlay build -quota 10G
+  sudo chroot-prep status -dir /mnt/base -overlay build
+
+  # Find out why overlays cannot be set up on this host
+  sudo chroot-prep check -dir /mnt/base -overlay projectA
+
+  # Repair what a crash left behind
+  sudo chroot-prep doctor -fix
+
   # Cleanup specific overlay
   sudo chroot-prep cleanup -dir /mnt/base -overlay projectA
 
+  # Same, from the overlay's merged path
+  sudo chroot-prep cleanup -dir /mnt/base.projectA/merged
+
+  # Unmount everything of a base before a reboot
+  sudo chroot-prep cleanup -dir /mnt/base -all
+
   # Remove everything (base + all overlays)
   sudo chroot-prep remove -dir /mnt/base
 
   # Remove only specific overlay (preserve base)
   sudo chroot-prep remove -dir /mnt/base -overlay projectA
 
+  # Branch an experiment from an existing overlay
+  sudo chroot-prep clone -dir /mnt/base -overlay projectA -to projectB
+
+  # Throw away an overlay's changes and start again
+  sudo chroot-prep reset -dir /mnt/base -overlay projectA -remount
+
+  # Promote an overlay to an immutable base version
+  sudo chroot-prep snapshot -dir /mnt/base -overlay projectA -as 2026-10-16
+
+  # Turn an overlay into a standalone environment, and back
+  sudo chroot-prep flatten -dir /mnt/base -overlay projectA -to /mnt/projectA
+  sudo chroot-prep split -dir /mnt/base -modified /mnt/projectA -overlay projectA
+
+  # Show how projectA differs from projectB
+  sudo chroot-prep diff -dir /mnt/base -overlay projectA -against projectB -content
+
+  # Keep a base as a compressed image and use it as the lower layer
+  sudo chroot-prep pack -dir /mnt/base -o /mnt/base.squashfs
+  sudo chroot-prep setup -dir /mnt/base.squashfs -overlay projectA
+
+  # Overlay as a writable btrfs snapshot of a base subvolume
+  sudo chroot-prep setup -dir /mnt/btrfs/base -overlay projectA -backend btrfs
+
+  # Create a base from an OCI image layout (e.g. from skopeo copy)
+  sudo chroot-prep import -oci ./debian-image -dir /mnt/base
+
+  # Move a base to another host
+  sudo chroot-prep export -dir /mnt/base -o base.tar.zst
+  sudo chroot-prep import -tar base.tar.zst -dir /mnt/base
+
 Note: This program requires root privileges (sudo)`
 
 	fmt.Println(usage)
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/zinrai/chroot-prep/chrootprep"
+)
+
+// printListing prints the versions and overlays of a base and their state
+func printListing(listing *chrootprep.Listing) {
+	fmt.Printf("Base: %s\n", listing.Base)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	defer w.Flush()
+
+	if len(listing.Versions) > 0 {
+		fmt.Fprintln(w, "VERSION\tCREATED\tFROM")
+		for _, version := range listing.Versions {
+			created, from := "-", "-"
+			if !version.Created.IsZero() {
+				created = version.Created.Format(time.DateTime)
+			}
+			if version.Overlay != "" {
+				from = fmt.Sprintf("%s (overlay %s)", filepath.Base(version.Source), version.Overlay)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\n", version.Version, created, from)
+		}
+		fmt.Fprintln(w)
+	}
+
+	if len(listing.Overlays) == 0 {
+		fmt.Fprintln(w, "No overlays")
+		return
+	}
+
+	fmt.Fprintln(w, "NAME\tSTATE\tPARENTS\tUSAGE\tDIRECTORY")
+	for _, overlay := range listing.Overlays {
+		state := "not mounted"
+		if overlay.Mounted {
+			state = "mounted"
+		}
+
+		parents := "-"
+		if len(overlay.Parents) > 0 {
+			parents = strings.Join(overlay.Parents, " > ")
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", overlay.Name, state, parents, overlay.Usage, overlay.Dir)
+	}
+}
+
+// printStatus prints the state, storage and usage of an overlay
+func printStatus(status *chrootprep.OverlayStatus) {
+	state := "not mounted"
+	if status.ReadOnly {
+		state = "mounted read-only"
+	} else if status.Mounted {
+		state = "mounted"
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	defer w.Flush()
+
+	fmt.Fprintf(w, "Overlay:\t%s\n", status.Name)
+	fmt.Fprintf(w, "Base:\t%s\n", status.Base)
+	fmt.Fprintf(w, "Directory:\t%s\n", status.Dir)
+	fmt.Fprintf(w, "State:\t%s\n", state)
+	fmt.Fprintf(w, "Storage:\t%s\n", status.Storage)
+	fmt.Fprintf(w, "Usage:\t%s\n", status.Usage)
+	if len(status.Parents) > 0 {
+		fmt.Fprintf(w, "Parents:\t%s\n", strings.Join(status.Parents, " > "))
+	}
+	if len(status.Options) > 0 {
+		fmt.Fprintf(w, "Options:\t%s\n", strings.Join(status.Options, ","))
+	}
+	if !status.Created.IsZero() {
+		fmt.Fprintf(w, "Created:\t%s\n", status.Created.Format(time.DateTime))
+	}
+}
+
+// printCheckResults prints the preflight checks, with how to fix each failure
+func printCheckResults(results []chrootprep.CheckResult) {
+	for _, result := range results {
+		if result.Err == nil {
+			fmt.Printf("  %-18s ok\n", result.Name)
+			continue
+		}
+
+		var preflightErr *chrootprep.PreflightError
+		if !errors.As(result.Err, &preflightErr) {
+			fmt.Printf("  %-18s error: %v\n", result.Name, result.Err)
+			continue
+		}
+
+		problem := preflightErr.Err.Error()
+		if preflightErr.Path != "" {
+			problem = preflightErr.Path + ": " + problem
+		}
+		fmt.Printf("  %-18s FAILED: %s\n", result.Name, problem)
+		fmt.Printf("  %-18s fix: %s\n", "", preflightErr.Fix)
+	}
+}
+
+// printIssues prints the problems found by doctor, and their repair
+func printIssues(issues []chrootprep.Issue, fixed bool) {
+	for _, issue := range issues {
+		fmt.Printf("%s: %s\n", issue.Kind, issue.Problem)
+		switch {
+		case !fixed:
+			fmt.Printf("  -> %s\n", issue.Repair)
+		case issue.Skipped:
+			fmt.Printf("  -> %s: skipped\n", issue.Repair)
+		case issue.Err != nil:
+			fmt.Printf("  -> %s: failed: %v\n", issue.Repair, issue.Err)
+		default:
+			fmt.Printf("  -> %s: done\n", issue.Repair)
+		}
+	}
+}
+
+// printCleanupResults prints the result of cleanup -all for each environment
+func printCleanupResults(chrootDir string, results []chrootprep.CleanupResult) {
+	if len(results) == 0 {
+		return
+	}
+
+	fmt.Printf("\nResults for %s:\n", chrootDir)
+	for _, result := range results {
+		fmt.Printf("  %-20s %s\n", result.Name, result.Result)
+	}
+}